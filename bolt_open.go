@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/state"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// boltLockTimeout bounds the wait for the lock of a bolt file, which a
+// running nomad agent holds for as long as it runs.
+const boltLockTimeout = time.Second
+
+// openRaftStore opens a raft.db file read-only.  If the file is locked by a
+// running agent, a temporary copy of it is opened instead.
+func openRaftStore(p string) (*raftboltdb.BoltStore, error) {
+	open := func(p string) (*raftboltdb.BoltStore, error) {
+		return raftboltdb.New(raftboltdb.Options{
+			Path:        p,
+			BoltOptions: &bolt.Options{ReadOnly: true, Timeout: boltLockTimeout},
+		})
+	}
+
+	store, err := open(p)
+	if err != bolt.ErrTimeout {
+		return store, err
+	}
+
+	cp, err := copyLocked(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// the copy is unlinked once open, as it isn't reopened by path
+	defer os.RemoveAll(filepath.Dir(cp))
+	return open(cp)
+}
+
+// openClientState opens a temporary copy of the client state db found in the
+// client dir, as the client state db upgrades its schema on open and must not
+// be opened in place.
+func openClientState(logger hclog.Logger, dir string) (state.StateDB, error) {
+	cp, err := copyBolt(filepath.Join(dir, "state.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	// the copy is unlinked once open, as it isn't reopened by path
+	defer os.RemoveAll(filepath.Dir(cp))
+	return state.NewBoltStateDB(logger, filepath.Dir(cp))
+}
+
+// copyBolt copies a bolt file into a new temporary dir, and returns the path
+// of the copy.  The file is copied within a read-only transaction, which
+// keeps agents from writing to it meanwhile, unless it's locked by a running
+// agent, in which case it's copied as is.
+func copyBolt(p string) (string, error) {
+	db, err := bolt.Open(p, 0600, &bolt.Options{ReadOnly: true, Timeout: boltLockTimeout})
+	if err == bolt.ErrTimeout {
+		return copyLocked(p)
+	} else if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	dir, err := ioutil.TempDir("", "nomad-debug-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp dir: %v", err)
+	}
+
+	cp := filepath.Join(dir, filepath.Base(p))
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(cp, 0600)
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to copy %s: %v", p, err)
+	}
+
+	return cp, nil
+}
+
+// copyLocked copies a bolt file locked by a running agent into a new
+// temporary dir, and returns the path of the copy.  As the agent may be
+// writing to the file, the copy may miss its latest changes.
+func copyLocked(p string) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s is locked, likely by a running nomad agent; reading a copy of it instead\n", p)
+
+	dir, err := ioutil.TempDir("", "nomad-debug-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp dir: %v", err)
+	}
+
+	cp := filepath.Join(dir, filepath.Base(p))
+	if err := copyFile(p, cp); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to copy locked file %s: %v", p, err)
+	}
+
+	return cp, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"encoding/base64"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/hashicorp/go-hclog"
@@ -22,46 +22,84 @@ func (a *ClientStateCommand) Help() string {
 	helpText := `
 Usage: nomad-debug client state <path_to_nomad_dir>
 
-  Emits a json representation of the stored client state in json form.
+  Emits a json representation of the stored client state in json form, as an
+  object keyed by allocation ID.  ndjson and csv output have a line per
+  allocation, holding its ID and its state.
+
+Options:
+
+  --format=<format>
+    Output format: json (default), ndjson or csv.
 `
 
 	return strings.TrimSpace(helpText)
 }
 
-func (c *ClientStateCommand) Name() string { return "raft logs" }
+func (c *ClientStateCommand) Name() string { return "client state" }
 
 func (c *ClientStateCommand) Synopsis() string {
 	return "output content of client state"
 }
 
 func (c *ClientStateCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *ClientStateCommand) run(args []string) (int, error) {
+	var fFormat string
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.StringVar(&fFormat, "format", "json", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
 	if len(args) != 1 {
-		return 1
+		return 1, fmt.Errorf("expected one arg but got %d", len(args))
 	}
 
+	dir, err := openDataDir(args[0], clientData)
+	if err != nil {
+		return 1, err
+	}
+	defer dir.Close()
+
 	logger := hclog.L()
 
-	p := filepath.Join(args[0], "client")
-	db, err := state.NewBoltStateDB(logger, p)
+	db, err := openClientState(logger, dir.clientDir)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to open client state: %v\n", err)
-		return 1
+		return 1, fmt.Errorf("failed to open client state: %v", err)
 	}
 	defer db.Close()
 
 	allocs, _, err := db.GetAllAllocations()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to get allocations: %v\n", err)
-		return 1
+		return 1, fmt.Errorf("failed to get allocations: %v", err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	f, err := NewFormatter(fFormat, out, []string{"AllocID", "Alloc"})
+	if err != nil {
+		return 1, err
+	}
+	if u, ok := f.(uniqueKeyWriter); ok {
+		u.SetUniqueKeys()
 	}
 
-	data := map[string]*clientStateAlloc{}
 	for _, alloc := range allocs {
 		allocID := alloc.ID
 		deployState, err := db.GetDeploymentStatus(allocID)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to get deployment status for %s: %v", allocID, err)
-			return 1
+			return 1, fmt.Errorf("failed to get deployment status for %s: %v", allocID, err)
 		}
 
 		tasks := map[string]*taskState{}
@@ -69,15 +107,13 @@ func (c *ClientStateCommand) Run(args []string) int {
 		for _, jt := range tg.Tasks {
 			ls, rs, err := db.GetTaskRunnerState(allocID, jt.Name)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "failed to get task runner state %s: %v", allocID, err)
-				return 1
+				return 1, fmt.Errorf("failed to get task runner state %s: %v", allocID, err)
 			}
 
 			var ds interface{}
 			err = ls.TaskHandle.GetDriverState(&ds)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "failed to parse driver state %s: %v", allocID, err)
-				return 1
+				return 1, fmt.Errorf("failed to parse driver state %s: %v", allocID, err)
 			}
 
 			tasks[jt.Name] = &taskState{
@@ -87,21 +123,21 @@ func (c *ClientStateCommand) Run(args []string) int {
 			}
 		}
 
-		data[allocID] = &clientStateAlloc{
+		err = f.Write(&clientStateAlloc{
 			Alloc:        alloc,
 			DeployStatus: deployState,
 			Tasks:        tasks,
+		}, allocID)
+		if err != nil {
+			return 1, fmt.Errorf("failed to encode output: %v", err)
 		}
 	}
 
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(data); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to encode output: %v\n", err)
-		return 1
+	if err := f.Close(); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
 	}
 
-	return 0
+	return 0, nil
 }
 
 func unwrapDriverState(rawDriverConfig string) (interface{}, error) {
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dataDirFiles are the files extracted from data dir archives, relative to
+// the data dir, by the kind of data they hold.  Entries ending with a slash
+// match all the files of a dir.
+var dataDirFiles = []struct {
+	path string
+	kind dataKind
+}{
+	{"server/raft/raft.db", serverData},
+	{"server/raft/snapshots/", serverData},
+	{"client/state.db", clientData},
+}
+
+// dataKind is the kind of data a command needs from a data dir.
+type dataKind int
+
+const (
+	serverData dataKind = 1 << iota
+	clientData
+)
+
+// dataDir locates the server and client data of a nomad data dir.
+type dataDir struct {
+	path string
+
+	// raftDB is the path of the raft.db file, and raftDir the dir holding the
+	// raft snapshots, or empty if no server data was found
+	raftDB  string
+	raftDir string
+
+	// clientDir is the dir holding the client state.db, or empty if no client
+	// data was found
+	clientDir string
+
+	cleanup func()
+}
+
+// openDataDir locates the data found at p, and fails if it lacks the needed
+// kinds of data.  p may be a raft.db or client state.db file, a raft, server,
+// client or whole data dir, or a tar, tar.gz or zip archive of a data dir, in
+// which case only the files of the needed kinds of data are extracted, into
+// a temporary dir removed on Close.
+func openDataDir(p string, need dataKind) (*dataDir, error) {
+	root, cleanup := p, func() {}
+	if isDataDirArchive(p) {
+		tmp, err := ioutil.TempDir("", "nomad-debug-data-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp dir: %v", err)
+		}
+
+		if err := extractDataDir(p, tmp, need); err != nil {
+			os.RemoveAll(tmp)
+			return nil, fmt.Errorf("failed to extract data dir archive %s: %v", p, err)
+		}
+		root, cleanup = tmp, func() { os.RemoveAll(tmp) }
+	}
+
+	dir, err := resolveDataDir(root)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	dir.path = p
+	dir.cleanup = cleanup
+
+	switch {
+	case need&serverData != 0 && dir.raftDB == "":
+		cleanup()
+		return nil, fmt.Errorf("no nomad server raft.db found in %s, %v", p, dir)
+	case need&clientData != 0 && dir.clientDir == "":
+		cleanup()
+		return nil, fmt.Errorf("no nomad client state.db found in %s, %v", p, dir)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: %v\n", p, dir)
+	return dir, nil
+}
+
+func (d *dataDir) Close() error {
+	d.cleanup()
+	return nil
+}
+
+// String describes the kinds of data found.
+func (d *dataDir) String() string {
+	switch {
+	case d.raftDB != "" && d.clientDir != "":
+		return "found server raft data and client state"
+	case d.raftDB != "":
+		return "found server raft data"
+	case d.clientDir != "":
+		return "found client state"
+	default:
+		return "found neither server raft data nor client state"
+	}
+}
+
+// resolveDataDir locates the server and client data at p, being a raft.db or
+// state.db file, or a raft, server, client or whole data dir.
+func resolveDataDir(p string) (*dataDir, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := &dataDir{}
+	if !fi.IsDir() {
+		if filepath.Base(p) == "state.db" {
+			dir.clientDir = filepath.Dir(p)
+		} else {
+			dir.raftDB, dir.raftDir = p, filepath.Dir(p)
+		}
+		return dir, nil
+	}
+
+	for _, rel := range []string{".", "raft", filepath.Join("server", "raft")} {
+		if isFile(filepath.Join(p, rel, "raft.db")) {
+			dir.raftDir = filepath.Join(p, rel)
+			dir.raftDB = filepath.Join(dir.raftDir, "raft.db")
+			break
+		}
+	}
+
+	for _, rel := range []string{".", "client"} {
+		if isFile(filepath.Join(p, rel, "state.db")) {
+			dir.clientDir = filepath.Join(p, rel)
+			break
+		}
+	}
+
+	return dir, nil
+}
+
+func isFile(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// isDataDirArchive returns whether p is a tar, tar.gz or zip file.
+func isDataDirArchive(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic, _ := bufio.NewReader(f).Peek(262)
+	return archiveFormat(magic) != ""
+}
+
+// archiveFormat returns the format of an archive given its first 262 bytes,
+// or empty if not an archive.
+func archiveFormat(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		return "zip"
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return "tar.gz"
+	case len(magic) == 262 && string(magic[257:262]) == "ustar":
+		return "tar"
+	}
+	return ""
+}
+
+// extractDataDir extracts the data dir files of the needed kinds of data
+// found in the archive at p into dir.  Archives may hold the data dir under
+// any parent dir, but only a single data dir, as the files of several ones,
+// e.g. of all the servers of a cluster, would overwrite each other.
+func extractDataDir(p, dir string, need dataKind) error {
+	found := 0
+	dataRoot := ""
+	err := walkArchive(p, func(name string, r io.Reader) error {
+		rel, ok := dataDirPath(name, need)
+		if !ok {
+			return nil
+		}
+
+		// the dir of the archive holding the data dir, as dataDirPath
+		// strips it
+		name = path.Clean("/" + name)
+		root := "." + name[:len(name)-len(rel)-1]
+		if found != 0 && root != dataRoot {
+			return fmt.Errorf("multiple data dirs found, under %s and %s, extract the one to use and pass it instead", dataRoot, root)
+		}
+		dataRoot = root
+
+		found++
+		return extractFile(r, dir, rel)
+	})
+	if err != nil {
+		return err
+	}
+
+	if found == 0 {
+		var expected []string
+		for _, f := range dataDirFiles {
+			if f.kind&need != 0 {
+				expected = append(expected, f.path)
+			}
+		}
+		return fmt.Errorf("no nomad data dir files found, expected any of %s", strings.Join(expected, ", "))
+	}
+	return nil
+}
+
+// walkArchive calls fn with the name and content of every regular file of the
+// tar, tar.gz or zip archive at p.
+func walkArchive(p string, fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(262)
+
+	switch archiveFormat(magic) {
+	case "zip":
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		archive, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			return err
+		}
+		return walkZip(archive, fn)
+	case "tar.gz":
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return walkTar(tar.NewReader(gz), fn)
+	case "tar":
+		return walkTar(tar.NewReader(br), fn)
+	default:
+		return fmt.Errorf("not a tar, tar.gz or zip file")
+	}
+}
+
+func walkTar(archive *tar.Reader, fn func(name string, r io.Reader) error) error {
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr.Name, archive); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(archive *zip.Reader, fn func(name string, r io.Reader) error) error {
+	for _, zf := range archive.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(zf.Name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, dir, rel string) error {
+	p := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to extract %s: %v", rel, err)
+	}
+	return f.Close()
+}
+
+// dataDirPath returns the path, relative to the data dir, of an archive entry
+// matching the dataDirFiles of the needed kinds of data.
+func dataDirPath(name string, need dataKind) (string, bool) {
+	// cleaning a rooted path drops any .. element
+	name = path.Clean("/" + name)
+
+	for _, f := range dataDirFiles {
+		if f.kind&need == 0 {
+			continue
+		}
+
+		i := strings.Index(name, "/"+f.path)
+		if i == -1 {
+			continue
+		}
+
+		rel := name[i+1:]
+		if rel == f.path || (strings.HasSuffix(f.path, "/") && len(rel) > len(f.path)) {
+			return rel, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDataDirPath(t *testing.T) {
+	cases := []struct {
+		name string
+		need dataKind
+		rel  string
+		ok   bool
+	}{
+		{"server/raft/raft.db", serverData, "server/raft/raft.db", true},
+		{"nomad/server/raft/raft.db", serverData, "server/raft/raft.db", true},
+		{"./data/nomad/server/raft/raft.db", serverData, "server/raft/raft.db", true},
+		{"/var/lib/nomad/server/raft/raft.db", serverData, "server/raft/raft.db", true},
+		{"../../server/raft/raft.db", serverData, "server/raft/raft.db", true},
+		{"nomad/server/raft/snapshots/2-10-1/state.bin", serverData, "server/raft/snapshots/2-10-1/state.bin", true},
+		{"nomad/server/raft/snapshots/2-10-1/meta.json", serverData | clientData, "server/raft/snapshots/2-10-1/meta.json", true},
+		{"server/raft/snapshots/../../../../etc/passwd", serverData, "", false},
+		{"server/raft/snapshots/../raft.db", serverData, "server/raft/raft.db", true},
+		{"server/raft/snapshots/", serverData, "", false},
+		{"server/raft/raft.db.bak", serverData, "", false},
+		{"myserver/raft/raft.db", serverData, "", false},
+		{"server/raft/peers.json", serverData, "", false},
+		{"client/state.db", serverData, "", false},
+		{"nomad/client/state.db", clientData, "client/state.db", true},
+		{"../client/state.db", clientData, "client/state.db", true},
+		{"server/raft/raft.db", clientData, "", false},
+		{"server/raft/snapshots/2-10-1/state.bin", clientData, "", false},
+		{"client/state.db", serverData | clientData, "client/state.db", true},
+	}
+
+	for _, c := range cases {
+		rel, ok := dataDirPath(c.name, c.need)
+		if rel != c.rel || ok != c.ok {
+			t.Errorf("dataDirPath(%q, %d): expected (%q, %v) but got (%q, %v)", c.name, c.need, c.rel, c.ok, rel, ok)
+			continue
+		}
+
+		if ok {
+			dir := filepath.FromSlash("/tmp/extract")
+			p := filepath.Join(dir, filepath.FromSlash(rel))
+			if !strings.HasPrefix(p, dir+string(filepath.Separator)) {
+				t.Errorf("dataDirPath(%q, %d): %q escapes the data dir", c.name, c.need, rel)
+			}
+		}
+	}
+}
+
+func TestExtractDataDir(t *testing.T) {
+	cases := []struct {
+		name      string
+		files     []string
+		need      dataKind
+		extracted []string
+		err       string
+	}{
+		{
+			name:      "single data dir",
+			files:     []string{"nomad/server/raft/raft.db", "nomad/server/raft/snapshots/2-10-1/state.bin", "nomad/client/state.db", "nomad/server/serf/local.keyring"},
+			need:      serverData,
+			extracted: []string{"server/raft/raft.db", "server/raft/snapshots/2-10-1/state.bin"},
+		},
+		{
+			name:      "client data",
+			files:     []string{"nomad/server/raft/raft.db", "nomad/client/state.db"},
+			need:      clientData,
+			extracted: []string{"client/state.db"},
+		},
+		{
+			name:  "multiple data dirs",
+			files: []string{"bundle/server1/server/raft/raft.db", "bundle/server2/server/raft/raft.db"},
+			need:  serverData,
+			err:   "multiple data dirs found, under ./bundle/server1 and ./bundle/server2",
+		},
+		{
+			name:  "snapshots of another data dir",
+			files: []string{"server/raft/raft.db", "other/server/raft/snapshots/2-10-1/state.bin"},
+			need:  serverData,
+			err:   "multiple data dirs found, under . and ./other",
+		},
+		{
+			name:      "other data dir of unneeded kind",
+			files:     []string{"server1/server/raft/raft.db", "client1/client/state.db"},
+			need:      serverData,
+			extracted: []string{"server/raft/raft.db"},
+		},
+		{
+			name:  "no data dir",
+			files: []string{"nomad/server/serf/local.keyring"},
+			need:  serverData | clientData,
+			err:   "no nomad data dir files found",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "nomad-debug-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+
+			archive := filepath.Join(tmp, "data.tar.gz")
+			writeTestTarGz(t, archive, c.files)
+
+			dir := filepath.Join(tmp, "out")
+			err = extractDataDir(archive, dir, c.need)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected error containing %q but got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var extracted []string
+			err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(dir, p)
+				extracted = append(extracted, filepath.ToSlash(rel))
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(extracted, ",") != strings.Join(c.extracted, ",") {
+				t.Fatalf("expected extracted files %v but got %v", c.extracted, extracted)
+			}
+		})
+	}
+}
+
+// writeTestTarGz writes a tar.gz archive at p holding the named files, each
+// holding its own name.
+func writeTestTarGz(t *testing.T, p string, names []string) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	archive := tar.NewWriter(gz)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(name)), Typeflag: tar.TypeReg}
+		if err := archive.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+const (
+	changeBundleOnly = "bundle-only"
+	changeRaftOnly   = "raft-only"
+)
+
+// bundleFiles maps the names of the API dumps of `nomad operator debug`
+// bundles to the state table they list, and to the type of their content.
+var bundleFiles = map[string]struct {
+	table   string
+	newList func() interface{}
+}{
+	"jobs.json":        {"Jobs", func() interface{} { return &[]*api.JobListStub{} }},
+	"allocations.json": {"Allocs", func() interface{} { return &[]*api.AllocationListStub{} }},
+	"evaluations.json": {"Evals", func() interface{} { return &[]*api.Evaluation{} }},
+	"deployments.json": {"Deployments", func() interface{} { return &[]*api.Deployment{} }},
+	"nodes.json":       {"Nodes", func() interface{} { return &[]*api.NodeListStub{} }},
+	"csi-volumes.json": {"CSIVolumes", func() interface{} { return &[]*api.CSIVolumeListStub{} }},
+	"csi-plugins.json": {"CSIPlugins", func() interface{} { return &[]*api.CSIPluginListStub{} }},
+	"namespaces.json":  {"Namespaces", func() interface{} { return &[]*api.Namespace{} }},
+}
+
+// bundleTableTypes returns the types of the objects of bundle tables, keyed
+// by table name.
+func bundleTableTypes() map[string]reflect.Type {
+	r := make(map[string]reflect.Type, len(bundleFiles))
+	for _, bf := range bundleFiles {
+		r[bf.table] = reflect.TypeOf(bf.newList()).Elem().Elem()
+	}
+	return r
+}
+
+// bundleKeyFields lists the fields identifying the objects of bundle tables,
+// for tables whose objects aren't identified by their ID alone.
+var bundleKeyFields = map[string][]string{
+	"Jobs":       {"Namespace", "ID"},
+	"CSIVolumes": {"Namespace", "ID"},
+	"Namespaces": {"Name"},
+}
+
+type DebugBundleCommand struct {
+}
+
+func (a *DebugBundleCommand) Help() string {
+	helpText := `
+Usage: nomad-debug debug bundle [options] <path_to_bundle>
+
+  Emits the jobs, allocations, evaluations, deployments, nodes, CSI volumes
+  and plugins, and namespaces found in a bundle produced by 'nomad operator
+  debug', as tables named like the ones of 'raft state'.  The bundle is
+  either a dir or a tar, tar.gz or zip archive of it.
+
+  Bundles hold the API list stubs of objects, i.e. a summary of the objects
+  found in the server state.  If the bundle holds multiple captures, the
+  latest one is used.
+
+Options:
+
+  --tables=<table>[,<table>...]
+    Emit only the given tables, e.g. allocs,evals.
+
+  --compare=<path_to_nomad_dir>
+    Instead of emitting the bundle tables, compare them to the state obtained
+    by replaying the raft log of the data dir.  Emits the objects found only
+    in the bundle or only in the replayed state, and the fields of common
+    objects that differ, with the replayed value as Old and the bundle value
+    as New.  Only fields holding scalar values on both sides are compared.
+
+  --last-index=<last_index>
+    Set the last log index to be applied when replaying the raft log, as in
+    'raft state'.
+
+  --format=<format>
+    Output format: json (default), ndjson or csv.  csv output of tables
+    requires --output-dir.
+
+  --output-dir=<dir>
+    Write each table to its own file in dir, named after the table, e.g.
+    Allocs.csv, instead of emitting all tables to stdout.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *DebugBundleCommand) Name() string { return "debug bundle" }
+
+func (c *DebugBundleCommand) Synopsis() string {
+	return "output content of a nomad operator debug bundle"
+}
+
+func (c *DebugBundleCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *DebugBundleCommand) run(args []string) (int, error) {
+	var fLastIdx int64
+	var fFormat, fOutputDir, fTables, fCompare string
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.Int64Var(&fLastIdx, "last-index", 0, "")
+	flags.StringVar(&fFormat, "format", "json", "")
+	flags.StringVar(&fOutputDir, "output-dir", "", "")
+	flags.StringVar(&fTables, "tables", "", "")
+	flags.StringVar(&fCompare, "compare", "", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) != 1 {
+		return 1, fmt.Errorf("expected one arg but got %d", len(args))
+	}
+
+	if fCompare == "" && fFormat == "csv" && fOutputDir == "" {
+		return 1, fmt.Errorf("csv output requires --output-dir")
+	}
+
+	tables, err := loadBundle(args[0])
+	if err != nil {
+		return 1, err
+	}
+
+	if fTables != "" {
+		tables, err = selectBundleTables(tables, fTables)
+		if err != nil {
+			return 1, err
+		}
+	}
+
+	if fCompare == "" {
+		if fOutputDir != "" {
+			err = writeTableFiles(fFormat, fOutputDir, tables, bundleTableTypes())
+		} else {
+			err = writeTables(fFormat, os.Stdout, tables)
+		}
+		if err != nil {
+			return 1, fmt.Errorf("failed to encode output: %v", err)
+		}
+		return 0, nil
+	}
+
+	dir, err := openDataDir(fCompare, serverData)
+	if err != nil {
+		return 1, err
+	}
+	defer dir.Close()
+
+	st, err := replayState(dir, fLastIdx)
+	if err != nil {
+		return 1, err
+	}
+	replayed, err := stateTables(st)
+	if err != nil {
+		return 1, err
+	}
+
+	diffs, err := compareBundle(tables, replayed)
+	if err != nil {
+		return 1, err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	f, err := NewFormatter(fFormat, out, []string{"Table", "Diff"})
+	if err != nil {
+		return 1, err
+	}
+
+	names := make([]string, 0, len(diffs))
+	for name := range diffs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, d := range diffs[name] {
+			if err := f.Write(d, name); err != nil {
+				return 1, fmt.Errorf("failed to encode output: %v", err)
+			}
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+
+	return 0, nil
+}
+
+// loadBundle returns the content of the API dumps found in the bundle dir or
+// archive at p, keyed by table name.
+func loadBundle(p string) (map[string][]interface{}, error) {
+	tables := map[string][]interface{}{}
+
+	// latest is the name of the file each table was loaded from, as bundles
+	// hold a capture per interval, named in increasing order
+	latest := map[string]string{}
+
+	load := func(name string, r io.Reader) error {
+		name = path.Clean("/" + filepath.ToSlash(name))
+
+		bf, ok := bundleFiles[path.Base(name)]
+		if !ok {
+			return nil
+		}
+		if prev, ok := latest[bf.table]; ok && prev > name {
+			return nil
+		}
+
+		list := bf.newList()
+		if err := json.NewDecoder(r).Decode(list); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to decode %s, skipping it: %v\n", name, err)
+			return nil
+		}
+
+		latest[bf.table] = name
+		tables[bf.table] = fromSlice(reflect.ValueOf(list).Elem().Interface())
+		return nil
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		err = filepath.Walk(p, func(fp string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+
+			rel, err := filepath.Rel(p, fp)
+			if err != nil {
+				return err
+			}
+
+			f, err := os.Open(fp)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return load(rel, f)
+		})
+	} else {
+		err = walkArchive(p, load)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle %s: %v", p, err)
+	}
+
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no nomad API dumps found in bundle %s", p)
+	}
+	return tables, nil
+}
+
+// selectBundleTables returns the tables of the comma separated list of
+// names, matched case insensitively.
+func selectBundleTables(tables map[string][]interface{}, names string) (map[string][]interface{}, error) {
+	known := map[string]string{}
+	for _, bf := range bundleFiles {
+		known[strings.ToLower(bf.table)] = bf.table
+	}
+
+	r := map[string][]interface{}{}
+	for _, n := range strings.Split(names, ",") {
+		n = strings.TrimSpace(n)
+		name, ok := known[strings.ToLower(n)]
+		if !ok {
+			return nil, fmt.Errorf("unknown table: %q", n)
+		}
+		if objs, ok := tables[name]; ok {
+			r[name] = objs
+		}
+	}
+	return r, nil
+}
+
+// compareBundle compares the bundle tables to the same tables of the
+// replayed state, and returns the differing objects of each table, sorted
+// by key.
+func compareBundle(bundle, replayed map[string][]interface{}) (map[string][]*objectDiff, error) {
+	result := map[string][]*objectDiff{}
+
+	for name, objs := range bundle {
+		stateObjs, ok := replayed[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "table %s isn't found in the replayed state, skipping it\n", name)
+			continue
+		}
+
+		diffs, err := compareBundleTable(name, objs, stateObjs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare table %s: %v", name, err)
+		}
+		if len(diffs) != 0 {
+			result[name] = diffs
+		}
+	}
+
+	return result, nil
+}
+
+func compareBundleTable(table string, bundleObjs, stateObjs []interface{}) ([]*objectDiff, error) {
+	type keyed struct {
+		obj     interface{}
+		generic map[string]interface{}
+	}
+
+	index := func(objs []interface{}) (map[string]*keyed, error) {
+		r := make(map[string]*keyed, len(objs))
+		for _, o := range objs {
+			g, err := toGeneric(o)
+			if err != nil {
+				return nil, err
+			}
+			m, _ := g.(map[string]interface{})
+			r[genericKey(table, m)] = &keyed{obj: o, generic: m}
+		}
+		return r, nil
+	}
+
+	inBundle, err := index(bundleObjs)
+	if err != nil {
+		return nil, err
+	}
+	inState, err := index(stateObjs)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []*objectDiff
+	for key, b := range inBundle {
+		s, ok := inState[key]
+		if !ok {
+			diffs = append(diffs, &objectDiff{Key: key, Change: changeBundleOnly, Object: b.obj})
+			continue
+		}
+
+		var fields []fieldDiff
+		for k, bv := range b.generic {
+			sv, ok := s.generic[k]
+			if ok && isScalar(bv) && isScalar(sv) && !reflect.DeepEqual(bv, sv) {
+				fields = append(fields, fieldDiff{Path: k, Old: sv, New: bv})
+			}
+		}
+		if len(fields) != 0 {
+			sort.Slice(fields, func(i, j int) bool { return fields[i].Path < fields[j].Path })
+			diffs = append(diffs, &objectDiff{Key: key, Change: changeUpdated, Fields: fields})
+		}
+	}
+
+	for key, s := range inState {
+		if _, ok := inBundle[key]; !ok {
+			diffs = append(diffs, &objectDiff{Key: key, Change: changeRaftOnly, Object: s.obj})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs, nil
+}
+
+// genericKey returns the key identifying an object, in its generic form,
+// within its table.
+func genericKey(table string, obj map[string]interface{}) string {
+	fields, ok := bundleKeyFields[table]
+	if !ok {
+		fields = []string{"ID"}
+	}
+
+	parts := make([]string, 0, len(fields))
+	for _, name := range fields {
+		if v, ok := obj[name]; ok {
+			parts = append(parts, fmt.Sprint(v))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestCompareBundleTable(t *testing.T) {
+	type change struct {
+		key    string
+		change string
+		fields []string
+	}
+
+	cases := []struct {
+		name    string
+		table   string
+		bundle  []interface{}
+		state   []interface{}
+		changes []change
+	}{
+		{
+			"jobs keyed by namespace and id",
+			"Jobs",
+			[]interface{}{
+				&structs.Job{Namespace: "default", ID: "a", Priority: 70, Status: "running", Meta: map[string]string{"k": "w"}},
+				&structs.Job{Namespace: "default", ID: "b"},
+				&structs.Job{Namespace: "prod", ID: "a", Priority: 50},
+			},
+			[]interface{}{
+				&structs.Job{Namespace: "default", ID: "a", Priority: 50, Status: "pending", Meta: map[string]string{"k": "v"}},
+				&structs.Job{Namespace: "default", ID: "c"},
+				&structs.Job{Namespace: "prod", ID: "a", Priority: 50},
+			},
+			[]change{
+				{"default/a", changeUpdated, []string{"Priority: 50 -> 70", "Status: pending -> running"}},
+				{"default/b", changeBundleOnly, nil},
+				{"default/c", changeRaftOnly, nil},
+			},
+		},
+		{
+			"partial bundle objects",
+			"Nodes",
+			[]interface{}{
+				map[string]interface{}{"ID": "n1", "Status": "down"},
+				map[string]interface{}{"ID": "n2", "Status": "ready"},
+			},
+			[]interface{}{
+				&structs.Node{ID: "n1", Name: "one", Status: "ready"},
+				&structs.Node{ID: "n2", Name: "two", Status: "ready"},
+			},
+			[]change{
+				{"n1", changeUpdated, []string{"Status: ready -> down"}},
+			},
+		},
+		{
+			"keyed by name",
+			"Namespaces",
+			[]interface{}{
+				map[string]interface{}{"Name": "default", "Description": "Default shared namespace"},
+			},
+			[]interface{}{},
+			[]change{
+				{"default", changeBundleOnly, nil},
+			},
+		},
+		{
+			"identical",
+			"Jobs",
+			[]interface{}{&structs.Job{Namespace: "default", ID: "a"}},
+			[]interface{}{&structs.Job{Namespace: "default", ID: "a"}},
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		diffs, err := compareBundleTable(c.table, c.bundle, c.state)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if len(diffs) != len(c.changes) {
+			t.Errorf("%s: expected %d changes but got %d", c.name, len(c.changes), len(diffs))
+			continue
+		}
+
+		for i, ch := range c.changes {
+			d := diffs[i]
+			if d.Key != ch.key || d.Change != ch.change {
+				t.Errorf("%s: change %d: expected %s %s but got %s %s", c.name, i, ch.key, ch.change, d.Key, d.Change)
+				continue
+			}
+
+			if ch.change != changeUpdated {
+				if d.Object == nil || d.Fields != nil {
+					t.Errorf("%s: %s: expected the %s object but got fields %v", c.name, ch.key, ch.change, d.Fields)
+				}
+				continue
+			}
+
+			var fields []string
+			for _, f := range d.Fields {
+				fields = append(fields, fmt.Sprintf("%s: %v -> %v", f.Path, f.Old, f.New))
+			}
+			if fmt.Sprint(fields) != fmt.Sprint(ch.fields) {
+				t.Errorf("%s: %s: expected fields %q but got %q", c.name, ch.key, ch.fields, fields)
+			}
+		}
+	}
+}
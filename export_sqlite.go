@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/raft"
+)
+
+type ExportSQLiteCommand struct {
+}
+
+func (a *ExportSQLiteCommand) Help() string {
+	helpText := `
+Usage: nomad-debug export sqlite <path_to_nomad_dir> <output_db>
+
+  Exports the nomad server state obtained by replaying the events of the raft
+  log, along with the raft log entries, into a new SQLite database.
+
+  Each state table becomes an SQLite table with a column per flattened field
+  and an Object column holding the full object as json.  Raft log entries are
+  stored in the RaftLogs table.
+
+  Only available in binaries built with '-tags sqlite', which requires cgo.
+
+Options:
+
+  --last-index=<last_index>
+    Set the last log index to be applied and exported. If passed last_index
+    is zero or negative, it's perceived as an offset from the last index seen
+    in raft.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *ExportSQLiteCommand) Name() string { return "export sqlite" }
+
+func (c *ExportSQLiteCommand) Synopsis() string {
+	return "export raft state and logs into an SQLite database"
+}
+
+func (c *ExportSQLiteCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *ExportSQLiteCommand) run(args []string) (int, error) {
+	var fLastIdx int64
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.Int64Var(&fLastIdx, "last-index", 0, "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) != 2 {
+		return 1, fmt.Errorf("expected two args but got %d", len(args))
+	}
+
+	if !sqliteSupported {
+		return 1, fmt.Errorf("not built with sqlite support, rebuild with -tags sqlite")
+	}
+
+	out := args[1]
+	if _, err := os.Stat(out); err == nil {
+		return 1, fmt.Errorf("output database %s already exists", out)
+	}
+
+	dir, err := openDataDir(args[0], serverData)
+	if err != nil {
+		return 1, err
+	}
+	defer dir.Close()
+
+	st, err := replayState(dir, fLastIdx)
+	if err != nil {
+		return 1, err
+	}
+
+	// a partially written database would look like a valid export
+	if err := exportDatabase(out, st, dir.raftDB, fLastIdx); err != nil {
+		os.Remove(out)
+		return 1, err
+	}
+
+	return 0, nil
+}
+
+// exportDatabase creates the SQLite database at p, holding the state tables
+// and the raft log entries up to cliLastIdx of the raft.db at raftDB.
+func exportDatabase(p string, st *state.StateStore, raftDB string, cliLastIdx int64) error {
+	db, err := sql.Open("sqlite3", p)
+	if err != nil {
+		return fmt.Errorf("failed to open output database: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tables, err := stateTables(st)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	types := stateTableTypes()
+	for _, name := range names {
+		if err := exportTable(tx, name, tables[name], types[name]); err != nil {
+			return fmt.Errorf("failed to export table %s: %v", name, err)
+		}
+	}
+
+	if err := exportRaftLogs(tx, raftDB, cliLastIdx); err != nil {
+		return fmt.Errorf("failed to export raft logs: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit output database: %v", err)
+	}
+
+	return nil
+}
+
+// exportTable creates an SQLite table for a state store table, with typed
+// columns derived from the flattened type t of its objects.  If t is nil, the
+// type of the first object is used.
+func exportTable(tx *sql.Tx, name string, objs []interface{}, t reflect.Type) error {
+	if t == nil && len(objs) != 0 {
+		t = reflect.TypeOf(objs[0])
+	}
+
+	var fields []flatField
+	if t != nil {
+		fields = flatFields(t)
+	}
+
+	// Skip unnamed columns of non-struct objects, those are found in Object
+	columns := make([]string, 0, len(fields)+1)
+	var named []flatField
+	for _, f := range fields {
+		if f.Name == "" {
+			continue
+		}
+		named = append(named, f)
+		columns = append(columns, quoteIdent(f.Name)+" "+sqlType(fieldType(t, f.index)))
+	}
+	columns = append(columns, quoteIdent("Object")+" TEXT")
+
+	create := fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(name), strings.Join(columns, ", "))
+	if _, err := tx.Exec(create); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(insertStatement(name, len(named)+1))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, o := range objs {
+		rv := reflect.ValueOf(o)
+
+		values := make([]interface{}, 0, len(named)+1)
+		for _, f := range named {
+			v, err := sqlValue(fieldByIndex(rv, f.index))
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		}
+
+		b, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		values = append(values, string(b))
+
+		if _, err := stmt.Exec(values...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportRaftLogs stores the decoded raft log entries in the RaftLogs table,
+// using the same columns as the csv output of raft logs.
+func exportRaftLogs(tx *sql.Tx, p string, cliLastIdx int64) error {
+	store, firstIdx, lastIdx, err := raftState(p)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	lastIdx = lastIndex(lastIdx, cliLastIdx)
+
+	headers := (&logMessage{}).csvHeaders()
+	columns := make([]string, len(headers))
+	for i, h := range headers {
+		t := "TEXT"
+		if h == "Index" || h == "Term" {
+			t = "INTEGER"
+		}
+		columns[i] = quoteIdent(h) + " " + t
+	}
+
+	create := fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent("RaftLogs"), strings.Join(columns, ", "))
+	if _, err := tx.Exec(create); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(insertStatement("RaftLogs", len(headers)))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := firstIdx; i <= lastIdx; i++ {
+		var e raft.Log
+		if err := store.GetLog(i, &e); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read log entry at index %d: %v\n", i, err)
+			continue
+		}
+
+		m, err := decode(&e)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to decode log entry at index %d: %v\n", i, err)
+			continue
+		}
+
+		row, err := m.csvRow()
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(row))
+		for j, v := range row {
+			values[j] = v
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func insertStatement(table string, n int) string {
+	params := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+	return fmt.Sprintf("INSERT INTO %s VALUES (%s)", quoteIdent(table), params)
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// fieldType returns the type of the struct field found at index.
+func fieldType(t reflect.Type, index []int) reflect.Type {
+	for _, i := range index {
+		t = derefType(t).Field(i).Type
+	}
+	return derefType(t)
+}
+
+func sqlType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "INTEGER"
+	case reflect.Float32, reflect.Float64:
+		return "REAL"
+	default:
+		return "TEXT"
+	}
+}
+
+func sqlValue(v reflect.Value) (interface{}, error) {
+	v = indirect(v)
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	}
+
+	cell, err := formatCell(v)
+	if err != nil {
+		return nil, err
+	}
+	if cell == "" {
+		return nil, nil
+	}
+	return cell, nil
+}
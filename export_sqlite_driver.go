@@ -0,0 +1,11 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	// the sqlite driver requires cgo, so it's only linked with -tags sqlite
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSupported = true
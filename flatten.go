@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFlattenDepth is the number of levels of nested structs that get
+// flattened into their own columns; deeper values are serialized as json.
+const maxFlattenDepth = 1
+
+// flatField is a column of a flattened struct.
+type flatField struct {
+	Name string
+
+	// index is the path of struct field indexes leading to the column value
+	index []int
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	timeType          = reflect.TypeOf(time.Time{})
+)
+
+// flatFields returns the columns of the flattened form of values of type t.
+// Non-struct types are flattened into a single unnamed column.
+func flatFields(t reflect.Type) []flatField {
+	t = derefType(t)
+	if !flattenable(t) {
+		return []flatField{{}}
+	}
+
+	return appendFlatFields(nil, t, "", nil, 0)
+}
+
+func appendFlatFields(fields []flatField, t reflect.Type, prefix string, index []int, depth int) []flatField {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		fIndex := make([]int, len(index)+1)
+		copy(fIndex, index)
+		fIndex[len(index)] = i
+
+		ft := derefType(f.Type)
+		switch {
+		case f.Anonymous && flattenable(ft):
+			fields = appendFlatFields(fields, ft, prefix, fIndex, depth)
+		case depth < maxFlattenDepth && flattenable(ft):
+			fields = appendFlatFields(fields, ft, prefix+f.Name+".", fIndex, depth+1)
+		default:
+			fields = append(fields, flatField{Name: prefix + f.Name, index: fIndex})
+		}
+	}
+
+	return fields
+}
+
+func flattenable(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || t == timeType {
+		return false
+	}
+
+	pt := reflect.PtrTo(t)
+	return !pt.Implements(jsonMarshalerType) && !pt.Implements(textMarshalerType)
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// flatValues returns the cells of the flattened v, matching the passed
+// columns.
+func flatValues(v interface{}, fields []flatField) ([]string, error) {
+	rv := reflect.ValueOf(v)
+
+	r := make([]string, len(fields))
+	for i, f := range fields {
+		cell, err := formatCell(fieldByIndex(rv, f.index))
+		if err != nil {
+			return nil, err
+		}
+		r[i] = cell
+	}
+	return r, nil
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but returns an invalid
+// value when hitting a nil pointer.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for _, i := range index {
+		v = indirect(v)
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}
+		}
+		v = v.Field(i)
+	}
+	return v
+}
+
+func formatCell(v reflect.Value) (string, error) {
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return "", nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64), nil
+	case reflect.Slice, reflect.Map:
+		if v.Len() == 0 {
+			return "", nil
+		}
+	}
+
+	if t, ok := v.Interface().(time.Time); ok {
+		if t.IsZero() {
+			return "", nil
+		}
+		return t.Format(time.RFC3339Nano), nil
+	}
+
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
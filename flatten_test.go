@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testInner struct {
+	Name  string
+	Count int
+}
+
+type testEmbedded struct {
+	Region string
+}
+
+type testDeep struct {
+	Inner testInner
+}
+
+type testRecord struct {
+	testEmbedded
+	ID    string
+	Inner *testInner
+	Deep  testDeep
+	When  time.Time
+	Tags  []string
+	Meta  map[string]string
+
+	hidden string
+}
+
+func TestFlatFields(t *testing.T) {
+	cases := []struct {
+		name  string
+		t     reflect.Type
+		names []string
+	}{
+		{
+			"struct",
+			reflect.TypeOf(testRecord{}),
+			[]string{"Region", "ID", "Inner.Name", "Inner.Count", "Deep.Inner", "When", "Tags", "Meta"},
+		},
+		{
+			"pointer to struct",
+			reflect.TypeOf(&testInner{}),
+			[]string{"Name", "Count"},
+		},
+		{"time", reflect.TypeOf(time.Time{}), []string{""}},
+		{"scalar", reflect.TypeOf(uint64(0)), []string{""}},
+		{"slice", reflect.TypeOf([]string{}), []string{""}},
+	}
+
+	for _, c := range cases {
+		var names []string
+		for _, f := range flatFields(c.t) {
+			names = append(names, f.Name)
+		}
+		if !reflect.DeepEqual(names, c.names) {
+			t.Errorf("%s: expected fields %q but got %q", c.name, c.names, names)
+		}
+	}
+}
+
+func TestFlatValues(t *testing.T) {
+	full := testRecord{
+		testEmbedded: testEmbedded{Region: "eu"},
+		ID:           "r1",
+		Inner:        &testInner{Name: "a", Count: 2},
+		Deep:         testDeep{Inner: testInner{Name: "b", Count: 3}},
+		When:         time.Date(2020, 4, 29, 16, 31, 41, 0, time.UTC),
+		Tags:         []string{"x", "y"},
+		Meta:         map[string]string{"k": "v"},
+	}
+
+	cases := []struct {
+		name  string
+		v     interface{}
+		cells []string
+	}{
+		{
+			"struct",
+			full,
+			[]string{"eu", "r1", "a", "2", `{"Name":"b","Count":3}`, "2020-04-29T16:31:41Z", `["x","y"]`, `{"k":"v"}`},
+		},
+		{
+			"pointer to struct",
+			&full,
+			[]string{"eu", "r1", "a", "2", `{"Name":"b","Count":3}`, "2020-04-29T16:31:41Z", `["x","y"]`, `{"k":"v"}`},
+		},
+		{
+			"zero values",
+			testRecord{ID: "r2"},
+			[]string{"", "r2", "", "", `{"Name":"","Count":0}`, "", "", ""},
+		},
+		{"uint", uint64(7), []string{"7"}},
+		{"negative int", -3, []string{"-3"}},
+		{"bool", true, []string{"true"}},
+		{"float", 1.5, []string{"1.5"}},
+		{"string", "s", []string{"s"}},
+		{"slice", []string{"x"}, []string{`["x"]`}},
+		{"nil pointer", (*testInner)(nil), []string{"", ""}},
+	}
+
+	for _, c := range cases {
+		cells, err := flatValues(c.v, flatFields(reflect.TypeOf(c.v)))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cells, c.cells) {
+			t.Errorf("%s: expected cells %q but got %q", c.name, c.cells, cells)
+		}
+	}
+}
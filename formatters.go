@@ -5,57 +5,363 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"reflect"
+	"strings"
 )
 
+// Formatter emits values, along with some identifying fields, in a specific
+// output format.
+//
+// Formatters are created with a list of headers: the names of the fields
+// passed to Write, followed by the name of the value itself.
 type Formatter interface {
 	io.Closer
 	Write(v interface{}, fields ...string) error
 }
 
+// groupWriter is implemented by formatters that nest values under their
+// leading field, so that groups without any values are emitted too.
+type groupWriter interface {
+	WriteGroup(key string) error
+}
+
+// typedWriter is implemented by formatters whose layout depends on the type
+// of the values, so that the layout is emitted even if no value is written.
+type typedWriter interface {
+	SetValueType(t reflect.Type)
+}
+
+// uniqueKeyWriter is implemented by formatters that can emit values keyed by
+// their leading field, rather than grouped under it, when every value has its
+// own key.
+type uniqueKeyWriter interface {
+	SetUniqueKeys()
+}
+
+// formats lists the supported values of the --format flag.
+var formats = []string{"json", "ndjson", "csv"}
+
+func NewFormatter(format string, writer io.Writer, headers []string) (Formatter, error) {
+	switch format {
+	case "json":
+		return NewJSONFormatter(writer, headers)
+	case "ndjson":
+		return NewNDJSONFormatter(writer, headers)
+	case "csv":
+		return NewCSVFormatter(writer, headers)
+	default:
+		return nil, fmt.Errorf("unsupported format %q, must be one of: %s", format, strings.Join(formats, ", "))
+	}
+}
+
+// csvRecord is implemented by values that lay out their own csv columns.
+type csvRecord interface {
+	csvHeaders() []string
+	csvRow() ([]string, error)
+}
+
+// CSVFormatter emits a csv row per value, with a column per key field
+// followed by the columns of the value.
+//
+// Values are flattened into columns by their struct fields, unless they
+// implement csvRecord.  The columns are derived from the first value written,
+// so all values are expected to be of the same type.
 type CSVFormatter struct {
-	w *csv.Writer
+	w       *csv.Writer
+	headers []string
+
+	// valueType is the type of the values, if known before any is written
+	valueType reflect.Type
+
+	started bool
+	fields  []flatField
 }
 
 func NewCSVFormatter(writer io.Writer, headers []string) (*CSVFormatter, error) {
-	w := csv.NewWriter(writer)
-	err := w.Write(headers)
-	if err != nil {
-		return nil, err
+	keys := headers
+	if len(keys) != 0 {
+		keys = keys[:len(keys)-1]
 	}
+
 	return &CSVFormatter{
-		w: csv.NewWriter(writer),
+		w:       csv.NewWriter(writer),
+		headers: keys,
 	}, nil
 }
 
+// SetValueType sets the type of the values, so that the columns are known
+// even if no value is written.
+func (f *CSVFormatter) SetValueType(t reflect.Type) {
+	f.valueType = t
+}
+
 func (f *CSVFormatter) Write(v interface{}, fields ...string) error {
-	b, err := json.Marshal(v)
+	if err := f.start(v); err != nil {
+		return err
+	}
+
+	var cells []string
+	var err error
+	if r, ok := v.(csvRecord); ok {
+		cells, err = r.csvRow()
+	} else {
+		cells, err = flatValues(v, f.fields)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to serialize v: %v", err)
 	}
 
-	r := append(fields, string(b))
+	r := make([]string, 0, len(fields)+len(cells))
+	r = append(r, fields...)
+	r = append(r, cells...)
 	return f.w.Write(r)
+}
 
+func (f *CSVFormatter) start(v interface{}) error {
+	if f.started {
+		return nil
+	}
+	f.started = true
+
+	t := f.valueType
+	if v != nil {
+		t = reflect.TypeOf(v)
+	}
+
+	headers := append([]string{}, f.headers...)
+	if r, ok := v.(csvRecord); ok {
+		headers = append(headers, r.csvHeaders()...)
+	} else if t != nil {
+		f.fields = flatFields(t)
+		for _, field := range f.fields {
+			name := field.Name
+			if name == "" {
+				name = "Value"
+			}
+			headers = append(headers, name)
+		}
+	}
+
+	return f.w.Write(headers)
 }
 
 func (f *CSVFormatter) Close() error {
+	if err := f.start(nil); err != nil {
+		return err
+	}
 	f.w.Flush()
-	return nil
+	return f.w.Error()
 }
 
+// JSONFormatter emits an indented json document as values are written.
+//
+// Values are emitted as a json array, unless the formatter has key fields,
+// in which case values are emitted as an object of arrays keyed by the first
+// field.  Values with the same key must be written consecutively.  With
+// unique keys, each value is emitted as is under its key instead.
 type JSONFormatter struct {
-	w *json.Encoder
+	w      io.Writer
+	keyed  bool
+	unique bool
+
+	started  bool
+	group    string
+	inGroup  bool
+	groupLen int
 }
 
 func NewJSONFormatter(writer io.Writer, headers []string) (*JSONFormatter, error) {
-	return nil, fmt.Errorf("not supported")
+	return &JSONFormatter{
+		w:     writer,
+		keyed: len(headers) > 1,
+	}, nil
+}
+
+// SetUniqueKeys emits values as the members of an object keyed by their
+// first field, which must be unique.
+func (f *JSONFormatter) SetUniqueKeys() {
+	f.unique = true
 }
 
 func (f *JSONFormatter) Write(v interface{}, fields ...string) error {
-	return fmt.Errorf("not supported")
+	if f.keyed {
+		if len(fields) == 0 {
+			return fmt.Errorf("missing key field")
+		}
+		if f.unique {
+			return f.writeMember(fields[0], v)
+		}
+		if err := f.WriteGroup(fields[0]); err != nil {
+			return err
+		}
+	} else if err := f.start(); err != nil {
+		return err
+	}
+
+	indent := "  "
+	if f.keyed {
+		indent = "    "
+	}
 
+	b, err := json.MarshalIndent(v, indent, "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize v: %v", err)
+	}
+
+	sep := ",\n"
+	if f.groupLen == 0 {
+		sep = "\n"
+	}
+	f.groupLen++
+
+	if _, err := io.WriteString(f.w, sep+indent); err != nil {
+		return err
+	}
+	_, err = f.w.Write(b)
+	return err
+}
+
+func (f *JSONFormatter) WriteGroup(key string) error {
+	if !f.keyed {
+		return fmt.Errorf("formatter has no key fields")
+	}
+	if f.unique {
+		return fmt.Errorf("formatter has unique keys")
+	}
+	if f.inGroup && f.group == key {
+		return nil
+	}
+
+	sep := ",\n"
+	if !f.started {
+		sep = "{\n"
+		f.started = true
+	}
+	if err := f.endGroup(); err != nil {
+		return err
+	}
+
+	k, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f.w, "%s  %s: [", sep, k); err != nil {
+		return err
+	}
+
+	f.group = key
+	f.inGroup = true
+	f.groupLen = 0
+	return nil
+}
+
+// writeMember emits v as the member of the top-level object named key.
+func (f *JSONFormatter) writeMember(key string, v interface{}) error {
+	sep := ",\n"
+	if !f.started {
+		sep = "{\n"
+		f.started = true
+	}
+
+	k, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "  ", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize v: %v", err)
+	}
+
+	if _, err := fmt.Fprintf(f.w, "%s  %s: ", sep, k); err != nil {
+		return err
+	}
+	_, err = f.w.Write(b)
+	return err
+}
+
+func (f *JSONFormatter) start() error {
+	if f.started {
+		return nil
+	}
+	f.started = true
+	_, err := io.WriteString(f.w, "[")
+	return err
+}
+
+func (f *JSONFormatter) endGroup() error {
+	if !f.inGroup {
+		return nil
+	}
+	f.inGroup = false
+
+	end := "\n  ]"
+	if f.groupLen == 0 {
+		end = "]"
+	}
+	_, err := io.WriteString(f.w, end)
+	return err
 }
 
 func (f *JSONFormatter) Close() error {
+	if f.keyed {
+		if !f.started {
+			_, err := io.WriteString(f.w, "{}\n")
+			return err
+		}
+		if err := f.endGroup(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(f.w, "\n}\n")
+		return err
+	}
+
+	if !f.started {
+		_, err := io.WriteString(f.w, "[]\n")
+		return err
+	}
+
+	end := "\n]\n"
+	if f.groupLen == 0 {
+		end = "]\n"
+	}
+	_, err := io.WriteString(f.w, end)
+	return err
+}
+
+// NDJSONFormatter emits one json object per line.
+//
+// If the formatter has key fields, each line is an object holding the fields
+// and the value under their header names.
+type NDJSONFormatter struct {
+	enc     *json.Encoder
+	headers []string
+}
+
+func NewNDJSONFormatter(writer io.Writer, headers []string) (*NDJSONFormatter, error) {
+	return &NDJSONFormatter{
+		enc:     json.NewEncoder(writer),
+		headers: headers,
+	}, nil
+}
+
+func (f *NDJSONFormatter) Write(v interface{}, fields ...string) error {
+	if len(f.headers) <= 1 {
+		return f.enc.Encode(v)
+	}
+
+	if len(fields) != len(f.headers)-1 {
+		return fmt.Errorf("expected %d fields but got %d", len(f.headers)-1, len(fields))
+	}
+
+	r := make(map[string]interface{}, len(f.headers))
+	for i, field := range fields {
+		r[f.headers[i]] = field
+	}
+	r[f.headers[len(f.headers)-1]] = v
+
+	return f.enc.Encode(r)
+}
+
+func (f *NDJSONFormatter) Close() error {
 	return nil
 }
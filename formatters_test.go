@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCSVFormatter(t *testing.T) {
+	type write struct {
+		v      interface{}
+		fields []string
+	}
+
+	cases := []struct {
+		name      string
+		headers   []string
+		valueType reflect.Type
+		writes    []write
+		out       string
+	}{
+		{
+			"keys and flattened values",
+			[]string{"Table", "Object"},
+			nil,
+			[]write{
+				{testInner{Name: "a", Count: 1}, []string{"t1"}},
+				{&testInner{Name: "b", Count: 2}, []string{"t2"}},
+			},
+			"Table,Name,Count\nt1,a,1\nt2,b,2\n",
+		},
+		{
+			"no keys",
+			[]string{"Object"},
+			nil,
+			[]write{{testInner{Name: "a", Count: 1}, nil}},
+			"Name,Count\na,1\n",
+		},
+		{
+			"nested values",
+			[]string{"Object"},
+			nil,
+			[]write{{testDeep{Inner: testInner{Name: "a", Count: 1}}, nil}},
+			"Inner.Name,Inner.Count\na,1\n",
+		},
+		{
+			"quoted cells",
+			[]string{"Object"},
+			nil,
+			[]write{{testInner{Name: "a,b", Count: 1}, nil}},
+			"Name,Count\n\"a,b\",1\n",
+		},
+		{
+			"non-struct values",
+			[]string{"Key", "Count"},
+			nil,
+			[]write{{uint64(5), []string{"k"}}},
+			"Key,Value\nk,5\n",
+		},
+		{
+			"empty with value type",
+			[]string{"Table", "Object"},
+			reflect.TypeOf(&testInner{}),
+			nil,
+			"Table,Name,Count\n",
+		},
+		{
+			"empty without value type",
+			[]string{"Table", "Object"},
+			nil,
+			nil,
+			"Table\n",
+		},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		f, err := NewCSVFormatter(&buf, c.headers)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		if c.valueType != nil {
+			f.SetValueType(c.valueType)
+		}
+
+		for _, w := range c.writes {
+			if err := f.Write(w.v, w.fields...); err != nil {
+				t.Fatalf("%s: failed to write %v: %v", c.name, w.v, err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("%s: failed to close: %v", c.name, err)
+		}
+
+		if buf.String() != c.out {
+			t.Errorf("%s: expected output %q but got %q", c.name, c.out, buf.String())
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	kindJob        = "job"
+	kindNode       = "node"
+	kindAlloc      = "alloc"
+	kindEval       = "eval"
+	kindDeployment = "deployment"
+	kindNamespace  = "namespace"
+
+	// kindJobKey holds the keys of jobs made of their namespace and ID, see
+	// jobKey, as jobs of different namespaces may share their ID
+	kindJobKey = "job key"
+)
+
+// idFields maps the names of fields holding object IDs to the kind of the
+// referenced object.
+var idFields = map[string]string{
+	"JobID":              kindJob,
+	"NodeID":             kindNode,
+	"NodeIDs":            kindNode,
+	"AllocID":            kindAlloc,
+	"AllocationID":       kindAlloc,
+	"PreviousAllocation": kindAlloc,
+	"NextAllocation":     kindAlloc,
+	"EvalID":             kindEval,
+	"PreviousEval":       kindEval,
+	"NextEval":           kindEval,
+	"BlockedEval":        kindEval,
+	"DeploymentID":       kindDeployment,
+	"Namespace":          kindNamespace,
+}
+
+// objectFields maps the names of fields holding objects, or lists of
+// objects, to their kind.  The object ID is found in their ID field.  Lists of
+// strings are perceived as lists of IDs, and maps without an ID field as maps
+// keyed by ID.
+var objectFields = map[string]string{
+	"Job":             kindJob,
+	"Node":            kindNode,
+	"Alloc":           kindAlloc,
+	"Allocs":          kindAlloc,
+	"AllocsStopped":   kindAlloc,
+	"AllocsUpdated":   kindAlloc,
+	"AllocsPreempted": kindAlloc,
+	"NodePreemptions": kindAlloc,
+	"Eval":            kindEval,
+	"Evals":           kindEval,
+	"Deployment":      kindDeployment,
+}
+
+// keyedFields maps the names of fields holding maps keyed by object ID to the
+// kind of the object.
+var keyedFields = map[string]string{
+	"NodeUpdate":     kindNode,
+	"NodeAllocation": kindNode,
+	"NodeEvents":     kindNode,
+}
+
+// namespacedKeyedFields maps the names of fields holding maps keyed by
+// "<namespace>.<id>" strings, as rendered by jsonifyJobBatchDeregisterRequest,
+// to the kind of the object.  Namespaces can't hold dots, while IDs can.
+var namespacedKeyedFields = map[string]string{
+	"Jobs": kindJob,
+}
+
+// objectIDs holds the IDs of objects referenced by a raft log entry, by kind.
+type objectIDs map[string]map[string]struct{}
+
+func bodyIDs(body interface{}) objectIDs {
+	ids := objectIDs{}
+	ids.walk(reflect.ValueOf(body))
+	return ids
+}
+
+// sorted returns the IDs of the given kind, sorted.
+func (ids objectIDs) sorted(kind string) []string {
+	r := make([]string, 0, len(ids[kind]))
+	for id := range ids[kind] {
+		r = append(r, id)
+	}
+	sort.Strings(r)
+	return r
+}
+
+func (ids objectIDs) add(kind, id string) {
+	if id == "" {
+		return
+	}
+
+	m, ok := ids[kind]
+	if !ok {
+		m = map[string]struct{}{}
+		ids[kind] = m
+	}
+	m[id] = struct{}{}
+}
+
+// addID adds the ID of an object of the given kind, found in namespace ns.
+func (ids objectIDs) addID(kind, ns, id string) {
+	ids.add(kind, id)
+	if kind == kindJob && id != "" {
+		ids.add(kindJobKey, jobKey(ns, id))
+	}
+}
+
+// jobKey returns the key of a job made of its namespace and ID, e.g.
+// default/example.  Jobs lacking a namespace are in the default namespace.
+func jobKey(ns, id string) string {
+	if ns == "" {
+		ns = structs.DefaultNamespace
+	}
+	return ns + "/" + id
+}
+
+// namespaceOf returns the namespace held by the Namespace field or key of a
+// struct or map, if any.
+func namespaceOf(v reflect.Value) string {
+	var ns reflect.Value
+	switch v.Kind() {
+	case reflect.Struct:
+		ns = v.FieldByName("Namespace")
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			ns = v.MapIndex(reflect.ValueOf("Namespace"))
+		}
+	}
+
+	ns = indirect(ns)
+	if ns.Kind() != reflect.String {
+		return ""
+	}
+	return ns.String()
+}
+
+func (ids objectIDs) walk(v reflect.Value) {
+	v = indirect(v)
+
+	switch v.Kind() {
+	case reflect.Struct:
+		ns := namespaceOf(v)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Anonymous {
+				ids.walk(v.Field(i))
+				continue
+			}
+			ids.walkField(f.Name, v.Field(i), ns)
+		}
+	case reflect.Map:
+		ns := namespaceOf(v)
+		stringKeys := v.Type().Key().Kind() == reflect.String
+		for _, k := range v.MapKeys() {
+			if stringKeys {
+				ids.walkField(k.String(), v.MapIndex(k), ns)
+			} else {
+				ids.walk(v.MapIndex(k))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			ids.walk(v.Index(i))
+		}
+	}
+}
+
+// walkField collects the IDs found in the field name of an object in
+// namespace ns.
+func (ids objectIDs) walkField(name string, v reflect.Value, ns string) {
+	if kind, ok := idFields[name]; ok {
+		ids.addStrings(kind, v, ns)
+		return
+	}
+	if kind, ok := objectFields[name]; ok {
+		ids.addObjects(kind, v, ns)
+	}
+	if kind, ok := keyedFields[name]; ok {
+		ids.addKeys(kind, v, ns)
+	}
+	if kind, ok := namespacedKeyedFields[name]; ok {
+		ids.addNamespacedKeys(kind, v)
+	}
+
+	ids.walk(v)
+}
+
+func (ids objectIDs) addStrings(kind string, v reflect.Value, ns string) {
+	v = indirect(v)
+
+	switch v.Kind() {
+	case reflect.String:
+		ids.addID(kind, ns, v.String())
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			ids.addStrings(kind, v.Index(i), ns)
+		}
+	}
+}
+
+// addObjects collects the IDs of objects, found in namespace ns unless they
+// hold their own namespace.
+func (ids objectIDs) addObjects(kind string, v reflect.Value, ns string) {
+	v = indirect(v)
+
+	switch v.Kind() {
+	case reflect.String:
+		ids.addID(kind, ns, v.String())
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			ids.addObjects(kind, v.Index(i), ns)
+		}
+	case reflect.Struct:
+		if f := v.FieldByName("ID"); f.IsValid() {
+			if objNS := namespaceOf(v); objNS != "" {
+				ns = objNS
+			}
+			ids.addStrings(kind, f, ns)
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return
+		}
+		if id := v.MapIndex(reflect.ValueOf("ID")); id.IsValid() {
+			if objNS := namespaceOf(v); objNS != "" {
+				ns = objNS
+			}
+			ids.addStrings(kind, id, ns)
+			return
+		}
+		ids.addKeys(kind, v, ns)
+	}
+}
+
+func (ids objectIDs) addKeys(kind string, v reflect.Value, ns string) {
+	v = indirect(v)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return
+	}
+
+	for _, k := range v.MapKeys() {
+		ids.addID(kind, ns, k.String())
+	}
+}
+
+func (ids objectIDs) addNamespacedKeys(kind string, v reflect.Value) {
+	v = indirect(v)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return
+	}
+
+	for _, k := range v.MapKeys() {
+		parts := strings.SplitN(k.String(), ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		ids.add(kindNamespace, parts[0])
+		ids.addID(kind, parts[0], parts[1])
+	}
+}
+
+// timeFields lists the names of fields holding a unix nano timestamp of when
+// an object was updated.
+var timeFields = map[string]bool{
+	"CreateTime": true,
+	"ModifyTime": true,
+	"SubmitTime": true,
+}
+
+// entryTime returns the latest object timestamp found in the body of a raft
+// log entry, approximating the time the entry was committed.
+func entryTime(body interface{}) (time.Time, bool) {
+	var latest int64
+	walkTimes(reflect.ValueOf(body), "", &latest)
+
+	if latest == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, latest), true
+}
+
+func walkTimes(v reflect.Value, name string, latest *int64) {
+	v = indirect(v)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int64:
+		if timeFields[name] && v.Int() > *latest {
+			*latest = v.Int()
+		}
+	case reflect.Uint, reflect.Uint64:
+		if timeFields[name] && int64(v.Uint()) > *latest {
+			*latest = int64(v.Uint())
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				walkTimes(v.Field(i), f.Name, latest)
+			}
+		}
+	case reflect.Map:
+		stringKeys := v.Type().Key().Kind() == reflect.String
+		for _, k := range v.MapKeys() {
+			n := ""
+			if stringKeys {
+				n = k.String()
+			}
+			walkTimes(v.MapIndex(k), n, latest)
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			walkTimes(v.Index(i), "", latest)
+		}
+	}
+}
+
+// indirect dereferences pointers and interfaces until reaching a concrete
+// value.
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// logFilter selects the raft log entries to be emitted.
+type logFilter struct {
+	commandTypes map[string]bool
+
+	// ids maps object kinds to the requested id.  Job IDs must match
+	// exactly, while other IDs may be a uuid prefix.
+	ids map[string]string
+}
+
+func newLogFilter(commandTypes string, ids map[string]string) (*logFilter, error) {
+	f := &logFilter{
+		ids: map[string]string{},
+	}
+
+	if commandTypes != "" {
+		known := make(map[string]string, len(msgTypeNames))
+		for _, n := range msgTypeNames {
+			known[strings.ToLower(n)] = n
+		}
+
+		f.commandTypes = map[string]bool{}
+		for _, t := range strings.Split(commandTypes, ",") {
+			t = strings.TrimSpace(t)
+			n, ok := known[strings.ToLower(t)]
+			if !ok {
+				return nil, fmt.Errorf("unknown command type: %q", t)
+			}
+			f.commandTypes[n] = true
+		}
+	}
+
+	for kind, id := range ids {
+		if id != "" {
+			f.ids[kind] = id
+		}
+	}
+
+	return f, nil
+}
+
+func (f *logFilter) match(m *logMessage) bool {
+	if len(f.commandTypes) != 0 && !f.commandTypes[m.CommandType] {
+		return false
+	}
+
+	if len(f.ids) == 0 {
+		return true
+	}
+
+	found := bodyIDs(m.Body)
+	for kind, want := range f.ids {
+		if !matchID(kind, want, found[kind]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchID(kind, want string, ids map[string]struct{}) bool {
+	if kind == kindJob {
+		_, ok := ids[want]
+		return ok
+	}
+
+	for id := range ids {
+		if strings.HasPrefix(id, want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestBodyIDs(t *testing.T) {
+	cases := []struct {
+		name string
+		body interface{}
+		ids  map[string][]string
+	}{
+		{
+			"job register",
+			&structs.JobRegisterRequest{
+				Job: &structs.Job{ID: "web", Namespace: "prod"},
+			},
+			map[string][]string{
+				kindJob:       {"web"},
+				kindJobKey:    {"prod/web"},
+				kindNamespace: {"prod"},
+			},
+		},
+		{
+			"eval update",
+			&structs.EvalUpdateRequest{
+				Evals: []*structs.Evaluation{{
+					ID:           "e1",
+					Namespace:    "prod",
+					JobID:        "web",
+					NodeID:       "n1",
+					DeploymentID: "d1",
+					PreviousEval: "e0",
+				}},
+			},
+			map[string][]string{
+				kindEval:       {"e0", "e1"},
+				kindJob:        {"web"},
+				kindJobKey:     {"prod/web"},
+				kindNode:       {"n1"},
+				kindDeployment: {"d1"},
+				kindNamespace:  {"prod"},
+			},
+		},
+		{
+			"alloc update in default namespace",
+			&structs.AllocUpdateRequest{
+				Alloc: []*structs.Allocation{{
+					ID:     "a1",
+					NodeID: "n1",
+					JobID:  "web",
+					EvalID: "e1",
+				}},
+			},
+			map[string][]string{
+				kindAlloc:  {"a1"},
+				kindNode:   {"n1"},
+				kindJob:    {"web"},
+				kindJobKey: {"default/web"},
+				kindEval:   {"e1"},
+			},
+		},
+		{
+			"generic body",
+			map[string]interface{}{
+				"Job": map[string]interface{}{"ID": "web", "Namespace": "dev"},
+			},
+			map[string][]string{
+				kindJob:       {"web"},
+				kindJobKey:    {"dev/web"},
+				kindNamespace: {"dev"},
+			},
+		},
+		{
+			"keyed by node",
+			map[string]interface{}{
+				"NodeUpdate": map[string]interface{}{"n2": []interface{}{}},
+			},
+			map[string][]string{
+				kindNode: {"n2"},
+			},
+		},
+		{
+			"batch deregister",
+			jsonifyJobBatchDeregisterRequest(&structs.JobBatchDeregisterRequest{
+				Jobs: map[structs.NamespacedID]*structs.JobDeregisterOptions{
+					{ID: "web.v2", Namespace: "prod"}: {Purge: true},
+				},
+			}),
+			map[string][]string{
+				kindJob:       {"web.v2"},
+				kindJobKey:    {"prod/web.v2"},
+				kindNamespace: {"prod"},
+			},
+		},
+		{
+			"no ids",
+			&structs.JobRegisterRequest{},
+			map[string][]string{},
+		},
+	}
+
+	for _, c := range cases {
+		ids := bodyIDs(c.body)
+
+		for kind := range ids {
+			if _, ok := c.ids[kind]; !ok {
+				t.Errorf("%s: unexpected %s ids %v", c.name, kind, ids.sorted(kind))
+			}
+		}
+		for kind, want := range c.ids {
+			if got := ids.sorted(kind); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: expected %s ids %v but got %v", c.name, kind, want, got)
+			}
+		}
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+	msgs := []*logMessage{
+		{
+			CommandType: "JobRegisterRequestType",
+			Body: &structs.JobRegisterRequest{
+				Job: &structs.Job{ID: "web"},
+			},
+		},
+		{
+			CommandType: "EvalUpdateRequestType",
+			Body: &structs.EvalUpdateRequest{
+				Evals: []*structs.Evaluation{{
+					ID:     "5e1a0c2d-6f1b-4f0a-9b7e-0c8d2d3f4a5b",
+					JobID:  "web-api",
+					NodeID: "9f3b7c1e-2a4d-4e6f-8b0c-1d2e3f4a5b6c",
+				}},
+			},
+		},
+	}
+
+	cases := []struct {
+		name  string
+		types string
+		ids   map[string]string
+		match []bool
+		err   string
+	}{
+		{"no filter", "", nil, []bool{true, true}, ""},
+		{"type", "jobregisterrequesttype", nil, []bool{true, false}, ""},
+		{"types", "JobRegisterRequestType, EvalUpdateRequestType", nil, []bool{true, true}, ""},
+		{"unknown type", "JobRegister", nil, nil, `unknown command type: "JobRegister"`},
+		{"empty ids", "", map[string]string{kindJob: "", kindNode: ""}, []bool{true, true}, ""},
+		{"job exact", "", map[string]string{kindJob: "web"}, []bool{true, false}, ""},
+		{"job not a prefix", "", map[string]string{kindJob: "web-"}, []bool{false, false}, ""},
+		{"eval prefix", "", map[string]string{kindEval: "5e1a"}, []bool{false, true}, ""},
+		{"all ids match", "", map[string]string{kindEval: "5e1a", kindNode: "9f3b"}, []bool{false, true}, ""},
+		{"one id mismatch", "", map[string]string{kindEval: "5e1a", kindNode: "0000"}, []bool{false, false}, ""},
+		{"type and id", "JobRegisterRequestType", map[string]string{kindJob: "web-api"}, []bool{false, false}, ""},
+	}
+
+	for _, c := range cases {
+		f, err := newLogFilter(c.types, c.ids)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error %q but got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+
+		for i, m := range msgs {
+			if got := f.match(m); got != c.match[i] {
+				t.Errorf("%s: message %d: expected match %v but got %v", c.name, i, c.match[i], got)
+			}
+		}
+	}
+}
@@ -18,9 +18,42 @@ func main() {
 		"raft state": func() (cli.Command, error) {
 			return &RaftStateCommand{}, nil
 		},
+		"raft history": func() (cli.Command, error) {
+			return &RaftHistoryCommand{}, nil
+		},
+		"raft snapshots": func() (cli.Command, error) {
+			return &RaftSnapshotsCommand{}, nil
+		},
+		"raft snapshot dump": func() (cli.Command, error) {
+			return &RaftSnapshotDumpCommand{}, nil
+		},
+		"raft state-diff": func() (cli.Command, error) {
+			return &RaftStateDiffCommand{}, nil
+		},
+		"raft rewrite": func() (cli.Command, error) {
+			return &RaftRewriteCommand{}, nil
+		},
+		"raft check": func() (cli.Command, error) {
+			return &RaftCheckCommand{}, nil
+		},
+		"raft compare": func() (cli.Command, error) {
+			return &RaftCompareCommand{}, nil
+		},
+		"raft stats": func() (cli.Command, error) {
+			return &RaftStatsCommand{}, nil
+		},
 		"client state": func() (cli.Command, error) {
 			return &ClientStateCommand{}, nil
 		},
+		"export sqlite": func() (cli.Command, error) {
+			return &ExportSQLiteCommand{}, nil
+		},
+		"debug bundle": func() (cli.Command, error) {
+			return &DebugBundleCommand{}, nil
+		},
+		"serve": func() (cli.Command, error) {
+			return &ServeCommand{}, nil
+		},
 	}
 	cli := &cli.CLI{
 		Name:       "nomad-debug",
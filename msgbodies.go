@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// msgTypeBodies maps raft message types to constructors of the request struct
+// their body is encoded from, as found in the nomad server FSM.
+//
+// Bodies of message types not listed here are decoded generically.
+var msgTypeBodies = map[structs.MessageType]func() interface{}{
+	structs.NodeRegisterRequestType:                      func() interface{} { return &structs.NodeRegisterRequest{} },
+	structs.NodeDeregisterRequestType:                    func() interface{} { return &structs.NodeDeregisterRequest{} },
+	structs.NodeUpdateStatusRequestType:                  func() interface{} { return &structs.NodeUpdateStatusRequest{} },
+	structs.NodeUpdateDrainRequestType:                   func() interface{} { return &structs.NodeUpdateDrainRequest{} },
+	structs.JobRegisterRequestType:                       func() interface{} { return &structs.JobRegisterRequest{} },
+	structs.JobDeregisterRequestType:                     func() interface{} { return &structs.JobDeregisterRequest{} },
+	structs.EvalUpdateRequestType:                        func() interface{} { return &structs.EvalUpdateRequest{} },
+	structs.EvalDeleteRequestType:                        func() interface{} { return &structs.EvalDeleteRequest{} },
+	structs.AllocUpdateRequestType:                       func() interface{} { return &structs.AllocUpdateRequest{} },
+	structs.AllocClientUpdateRequestType:                 func() interface{} { return &structs.AllocUpdateRequest{} },
+	structs.ReconcileJobSummariesRequestType:             func() interface{} { return &structs.GenericRequest{} },
+	structs.VaultAccessorRegisterRequestType:             func() interface{} { return &structs.VaultAccessorsRequest{} },
+	structs.VaultAccessorDeregisterRequestType:           func() interface{} { return &structs.VaultAccessorsRequest{} },
+	structs.ApplyPlanResultsRequestType:                  func() interface{} { return &structs.ApplyPlanResultsRequest{} },
+	structs.DeploymentStatusUpdateRequestType:            func() interface{} { return &structs.DeploymentStatusUpdateRequest{} },
+	structs.DeploymentPromoteRequestType:                 func() interface{} { return &structs.ApplyDeploymentPromoteRequest{} },
+	structs.DeploymentAllocHealthRequestType:             func() interface{} { return &structs.ApplyDeploymentAllocHealthRequest{} },
+	structs.DeploymentDeleteRequestType:                  func() interface{} { return &structs.DeploymentDeleteRequest{} },
+	structs.JobStabilityRequestType:                      func() interface{} { return &structs.JobStabilityRequest{} },
+	structs.ACLPolicyUpsertRequestType:                   func() interface{} { return &structs.ACLPolicyUpsertRequest{} },
+	structs.ACLPolicyDeleteRequestType:                   func() interface{} { return &structs.ACLPolicyDeleteRequest{} },
+	structs.ACLTokenUpsertRequestType:                    func() interface{} { return &structs.ACLTokenUpsertRequest{} },
+	structs.ACLTokenDeleteRequestType:                    func() interface{} { return &structs.ACLTokenDeleteRequest{} },
+	structs.ACLTokenBootstrapRequestType:                 func() interface{} { return &structs.ACLTokenBootstrapRequest{} },
+	structs.AutopilotRequestType:                         func() interface{} { return &structs.AutopilotSetConfigRequest{} },
+	structs.UpsertNodeEventsType:                         func() interface{} { return &structs.EmitNodeEventsRequest{} },
+	structs.JobBatchDeregisterRequestType:                func() interface{} { return &structs.JobBatchDeregisterRequest{} },
+	structs.AllocUpdateDesiredTransitionRequestType:      func() interface{} { return &structs.AllocUpdateDesiredTransitionRequest{} },
+	structs.NodeUpdateEligibilityRequestType:             func() interface{} { return &structs.NodeUpdateEligibilityRequest{} },
+	structs.BatchNodeUpdateDrainRequestType:              func() interface{} { return &structs.BatchNodeUpdateDrainRequest{} },
+	structs.SchedulerConfigRequestType:                   func() interface{} { return &structs.SchedulerSetConfigRequest{} },
+	structs.NodeBatchDeregisterRequestType:               func() interface{} { return &structs.NodeBatchDeregisterRequest{} },
+	structs.ClusterMetadataRequestType:                   func() interface{} { return &structs.ClusterMetadata{} },
+	structs.ServiceIdentityAccessorRegisterRequestType:   func() interface{} { return &structs.SITokenAccessorsRequest{} },
+	structs.ServiceIdentityAccessorDeregisterRequestType: func() interface{} { return &structs.SITokenAccessorsRequest{} },
+	structs.CSIVolumeRegisterRequestType:                 func() interface{} { return &structs.CSIVolumeRegisterRequest{} },
+	structs.CSIVolumeDeregisterRequestType:               func() interface{} { return &structs.CSIVolumeDeregisterRequest{} },
+	structs.CSIVolumeClaimRequestType:                    func() interface{} { return &structs.CSIVolumeClaimRequest{} },
+	structs.ScalingEventRegisterRequestType:              func() interface{} { return &structs.ScalingEventRequest{} },
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// Checks reported by raft check
+const (
+	checkMissingEntry    = "missing-entry"
+	checkTermRegression  = "term-regression"
+	checkFutureTerm      = "future-term"
+	checkEmptyCommand    = "empty-command"
+	checkUnknownType     = "unknown-type"
+	checkUndecodable     = "undecodable"
+	checkSnapshotGap     = "snapshot-gap"
+	checkSnapshotMissing = "snapshot-missing"
+)
+
+type RaftCheckCommand struct {
+}
+
+func (a *RaftCheckCommand) Help() string {
+	helpText := `
+Usage: nomad-debug raft check <path_to_nomad_dir>
+
+  Walks the raft log and reports anomalies:
+
+    missing-entry     an index between the first and last index has no entry
+    term-regression   an entry has a lower term than the entry preceding it
+    future-term       an entry has a higher term than CurrentTerm in the
+                      stable store
+    empty-command     a command entry holds no data
+    unknown-type      a command entry has a message type unknown to nomad
+    undecodable       a command body can't be decoded into its request type
+    snapshot-gap      the log doesn't start right after the latest snapshot
+    snapshot-missing  the log doesn't start at index 1 but no snapshot exists
+
+  Exits with 2 if any anomaly is found, or 1 on errors.
+
+Options:
+
+  --format=<format>
+    Output format: text (default), json, ndjson or csv.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *RaftCheckCommand) Name() string { return "raft check" }
+
+func (c *RaftCheckCommand) Synopsis() string {
+	return "report raft log anomalies"
+}
+
+func (c *RaftCheckCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *RaftCheckCommand) run(args []string) (int, error) {
+	var fFormat string
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.StringVar(&fFormat, "format", "text", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) != 1 {
+		return 1, fmt.Errorf("expected one arg but got %d", len(args))
+	}
+
+	dir, err := openDataDir(args[0], serverData)
+	if err != nil {
+		return 1, err
+	}
+	defer dir.Close()
+
+	p := dir.raftDB
+
+	store, firstIdx, lastIdx, err := raftState(p)
+	if err != nil {
+		return 1, fmt.Errorf("failed to open raft logs: %v", err)
+	}
+	defer store.Close()
+
+	snaps, err := openSnapshotStore(dir.raftDir)
+	if err != nil {
+		return 1, err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	var f Formatter
+	if fFormat != "text" {
+		f, err = NewFormatter(fFormat, out, []string{"Problem"})
+		if err != nil {
+			return 1, err
+		}
+	}
+
+	found := false
+	report := func(p *checkProblem) error {
+		found = true
+		if f == nil {
+			_, err := fmt.Fprintln(out, p)
+			return err
+		}
+		return f.Write(p)
+	}
+
+	if err := checkSnapshots(snaps, firstIdx, report); err != nil {
+		return 1, err
+	}
+	if err := checkLogs(store, firstIdx, lastIdx, report); err != nil {
+		return 1, err
+	}
+
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return 1, fmt.Errorf("failed to encode output: %v", err)
+		}
+	}
+
+	if found {
+		return 2, nil
+	}
+	return 0, nil
+}
+
+type checkProblem struct {
+	Index   uint64 `json:",omitempty"`
+	Check   string
+	Message string
+}
+
+func (p *checkProblem) String() string {
+	if p.Index == 0 {
+		return fmt.Sprintf("%s: %s", p.Check, p.Message)
+	}
+	return fmt.Sprintf("index %d: %s: %s", p.Index, p.Check, p.Message)
+}
+
+// checkSnapshots reports whether the raft log follows the latest snapshot.
+func checkSnapshots(snaps raft.SnapshotStore, firstIdx uint64, report func(*checkProblem) error) error {
+	if firstIdx <= 1 {
+		return nil
+	}
+
+	snapshots, err := snaps.List()
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %v", err)
+	}
+
+	// snapshots are listed newest first
+	if len(snapshots) == 0 {
+		return report(&checkProblem{
+			Check:   checkSnapshotMissing,
+			Message: fmt.Sprintf("log starts at index %d but no snapshot was found", firstIdx),
+		})
+	}
+
+	latest := snapshots[0]
+	if latest.Index+1 < firstIdx {
+		return report(&checkProblem{
+			Check: checkSnapshotGap,
+			Message: fmt.Sprintf("latest snapshot %v ends at index %d but log starts at index %d",
+				latest.ID, latest.Index, firstIdx),
+		})
+	}
+	return nil
+}
+
+// checkLogs reports anomalies of the log entries between firstIdx and
+// lastIdx.
+func checkLogs(store *raftboltdb.BoltStore, firstIdx, lastIdx uint64, report func(*checkProblem) error) error {
+	currentTerm, err := store.GetUint64([]byte("CurrentTerm"))
+	if err != nil && err != raftboltdb.ErrKeyNotFound {
+		return fmt.Errorf("failed to read CurrentTerm: %v", err)
+	}
+
+	if lastIdx == 0 {
+		return nil
+	}
+
+	prevTerm := uint64(0)
+	for i := firstIdx; i <= lastIdx; i++ {
+		var e raft.Log
+		err := store.GetLog(i, &e)
+		if err == raft.ErrLogNotFound {
+			if err := report(&checkProblem{Index: i, Check: checkMissingEntry, Message: "no entry found"}); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read log entry at index %d: %v", i, err)
+		}
+
+		var problems []*checkProblem
+		if e.Term < prevTerm {
+			problems = append(problems, &checkProblem{
+				Check:   checkTermRegression,
+				Message: fmt.Sprintf("term %d follows term %d", e.Term, prevTerm),
+			})
+		}
+		if currentTerm != 0 && e.Term > currentTerm {
+			problems = append(problems, &checkProblem{
+				Check:   checkFutureTerm,
+				Message: fmt.Sprintf("term %d is past CurrentTerm %d", e.Term, currentTerm),
+			})
+		}
+		if e.Type == raft.LogCommand {
+			if p := checkCommand(&e); p != nil {
+				problems = append(problems, p)
+			}
+		}
+
+		for _, p := range problems {
+			p.Index = i
+			if err := report(p); err != nil {
+				return err
+			}
+		}
+		prevTerm = e.Term
+	}
+
+	return nil
+}
+
+// checkCommand reports whether a command entry is of a known message type,
+// and its body decodes into the request type the FSM expects.
+func checkCommand(e *raft.Log) *checkProblem {
+	if len(e.Data) == 0 {
+		return &checkProblem{Check: checkEmptyCommand, Message: "command did not include data"}
+	}
+
+	msgType := structs.MessageType(e.Data[0])
+	ignoreUnknown := msgType&structs.IgnoreUnknownTypeFlag != 0
+	msgType &= ^structs.IgnoreUnknownTypeFlag
+
+	name, ok := msgTypeNames[msgType]
+	if !ok {
+		msg := fmt.Sprintf("message type %d", msgType)
+		if ignoreUnknown {
+			msg += " (flagged as ignorable)"
+		}
+		return &checkProblem{Check: checkUnknownType, Message: msg}
+	}
+
+	if newBody, ok := msgTypeBodies[msgType]; ok {
+		if err := structs.Decode(e.Data[1:], newBody()); err != nil {
+			return &checkProblem{Check: checkUndecodable, Message: fmt.Sprintf("%s: %v", name, err)}
+		}
+	} else if _, err := decodeGeneric(e.Data[1:]); err != nil {
+		return &checkProblem{Check: checkUndecodable, Message: fmt.Sprintf("%s: %v", name, err)}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+func TestCheckLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nomad-debug-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	valid, err := structs.Encode(structs.JobRegisterRequestType, &structs.JobRegisterRequest{Job: mock.Job()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// index 3 is missing
+	entries := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogCommand, Data: valid},
+		{Index: 2, Term: 2, Type: raft.LogNoop},
+		{Index: 4, Term: 1, Type: raft.LogCommand, Data: valid},
+		{Index: 5, Term: 2, Type: raft.LogCommand},
+		{Index: 6, Term: 2, Type: raft.LogCommand, Data: []byte{100}},
+		{Index: 7, Term: 2, Type: raft.LogCommand, Data: []byte{byte(structs.JobRegisterRequestType), 0xc1}},
+		{Index: 8, Term: 5, Type: raft.LogCommand, Data: valid},
+	}
+	if err := store.StoreLogs(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUint64([]byte("CurrentTerm"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	var problems []*checkProblem
+	err = checkLogs(store, 1, 8, func(p *checkProblem) error {
+		problems = append(problems, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		index uint64
+		check string
+	}{
+		{3, checkMissingEntry},
+		{4, checkTermRegression},
+		{5, checkEmptyCommand},
+		{6, checkUnknownType},
+		{7, checkUndecodable},
+		{8, checkFutureTerm},
+	}
+
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems but got %d: %v", len(expected), len(problems), problems)
+	}
+	for i, e := range expected {
+		if p := problems[i]; p.Index != e.index || p.Check != e.check {
+			t.Errorf("expected %s at index %d but got %v", e.check, e.index, p)
+		}
+	}
+}
+
+func TestCheckSnapshots(t *testing.T) {
+	cases := []struct {
+		name      string
+		snapshots []uint64
+		firstIdx  uint64
+		check     string
+	}{
+		{name: "log from start", firstIdx: 1},
+		{name: "empty log", firstIdx: 0},
+		{name: "missing snapshot", firstIdx: 10, check: checkSnapshotMissing},
+		{name: "snapshot gap", snapshots: []uint64{5}, firstIdx: 10, check: checkSnapshotGap},
+		{name: "latest snapshot gap", snapshots: []uint64{9, 20}, firstIdx: 30, check: checkSnapshotGap},
+		{name: "log follows snapshot", snapshots: []uint64{9}, firstIdx: 10},
+		{name: "log overlaps snapshot", snapshots: []uint64{5, 15}, firstIdx: 10},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "nomad-debug-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			for _, idx := range c.snapshots {
+				writeTestSnapshotMeta(t, dir, &raft.SnapshotMeta{
+					ID:      fmt.Sprintf("2-%d-1", idx),
+					Index:   idx,
+					Term:    2,
+					Version: raft.SnapshotVersionMax,
+				})
+			}
+
+			snaps, err := openSnapshotStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var problems []*checkProblem
+			err = checkSnapshots(snaps, c.firstIdx, func(p *checkProblem) error {
+				problems = append(problems, p)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case c.check == "" && len(problems) != 0:
+				t.Fatalf("expected no problems but got %v", problems)
+			case c.check != "" && (len(problems) != 1 || problems[0].Check != c.check):
+				t.Fatalf("expected a %s problem but got %v", c.check, problems)
+			}
+		})
+	}
+}
+
+// writeTestSnapshotMeta writes the metadata of a snapshot into the snapshots
+// dir of raftDir.
+func writeTestSnapshotMeta(t *testing.T, raftDir string, meta *raft.SnapshotMeta) {
+	p := filepath.Join(raftDir, "snapshots", meta.ID)
+	if err := os.MkdirAll(p, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(&snapshotDirMeta{SnapshotMeta: *meta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(p, "meta.json"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
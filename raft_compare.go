@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+type RaftCompareCommand struct {
+}
+
+func (a *RaftCompareCommand) Help() string {
+	helpText := `
+Usage: nomad-debug raft compare <path_to_nomad_dir> <path_to_nomad_dir>...
+
+  Compares the raft logs of the data dirs of the servers of a cluster,
+  aligning entries by index, and reports the indexes where the logs diverge,
+  i.e. where servers hold different entries.
+
+  Also emits the quorum index: the highest index whose entry is held by a
+  quorum of the servers.  It's the index to pass to 'raft state --last-index'
+  to drop uncommitted entries, assuming all the servers of the cluster are
+  passed.
+
+Options:
+
+  --format=<format>
+    Output format: text (default), json, ndjson or csv.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *RaftCompareCommand) Name() string { return "raft compare" }
+
+func (c *RaftCompareCommand) Synopsis() string {
+	return "compare raft logs of multiple servers"
+}
+
+func (c *RaftCompareCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *RaftCompareCommand) run(args []string) (int, error) {
+	var fFormat string
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.StringVar(&fFormat, "format", "text", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) < 2 {
+		return 1, fmt.Errorf("expected at least two args but got %d", len(args))
+	}
+
+	logs := make([]*serverLog, 0, len(args))
+	for _, arg := range args {
+		dir, err := openDataDir(arg, serverData)
+		if err != nil {
+			return 1, err
+		}
+		defer dir.Close()
+
+		l, err := openServerLog(dir)
+		if err != nil {
+			return 1, err
+		}
+		defer l.store.Close()
+
+		logs = append(logs, l)
+	}
+
+	result, err := compareLogs(logs)
+	if err != nil {
+		return 1, err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	if fFormat == "text" {
+		result.writeText(out)
+		return 0, nil
+	}
+
+	f, err := NewFormatter(fFormat, out, []string{"Comparison"})
+	if err != nil {
+		return 1, err
+	}
+	if err := f.Write(result); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+
+	return 0, nil
+}
+
+// serverLog is the raft log of a single server.
+type serverLog struct {
+	store *raftboltdb.BoltStore
+
+	Path       string
+	FirstIndex uint64
+	LastIndex  uint64
+	LastTerm   uint64
+}
+
+func openServerLog(dir *dataDir) (*serverLog, error) {
+	store, firstIdx, lastIdx, err := raftState(dir.raftDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft logs of %s: %v", dir.path, err)
+	}
+
+	l := &serverLog{
+		store:      store,
+		Path:       dir.path,
+		FirstIndex: firstIdx,
+		LastIndex:  lastIdx,
+	}
+
+	if lastIdx != 0 {
+		var e raft.Log
+		if err := store.GetLog(lastIdx, &e); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("failed to read log entry of %s at index %d: %v", dir.path, lastIdx, err)
+		}
+		l.LastTerm = e.Term
+	}
+
+	return l, nil
+}
+
+// entry returns the log entry at idx, or nil if the server doesn't hold it.
+func (l *serverLog) entry(idx uint64) (*raft.Log, error) {
+	if idx < l.FirstIndex || idx > l.LastIndex {
+		return nil, nil
+	}
+
+	var e raft.Log
+	err := l.store.GetLog(idx, &e)
+	if err == raft.ErrLogNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read log entry of %s at index %d: %v", l.Path, idx, err)
+	}
+	return &e, nil
+}
+
+type raftComparison struct {
+	Servers []*serverLog
+
+	// QuorumIndex is the highest index whose entry is held by QuorumSize
+	// servers, and QuorumTerm the term of that entry
+	QuorumSize  int
+	QuorumIndex uint64
+	QuorumTerm  uint64
+
+	Divergences []*logDivergence
+}
+
+// logDivergence is an index at which servers start holding different
+// entries, after having agreed on the entry at the preceding index.
+type logDivergence struct {
+	Index uint64
+
+	// Terms are the terms of the entries held by each server, keyed by
+	// path; servers not holding the entry are omitted
+	Terms map[string]uint64
+}
+
+// compareLogs aligns the entries of the server logs by index, and finds the
+// quorum index and the indexes where logs diverge.
+func compareLogs(logs []*serverLog) (*raftComparison, error) {
+	r := &raftComparison{
+		Servers:     logs,
+		QuorumSize:  len(logs)/2 + 1,
+		Divergences: []*logDivergence{},
+	}
+
+	from, to := logs[0].FirstIndex, logs[0].LastIndex
+	for _, l := range logs[1:] {
+		if l.FirstIndex < from {
+			from = l.FirstIndex
+		}
+		if l.LastIndex > to {
+			to = l.LastIndex
+		}
+	}
+	if to == 0 {
+		return r, nil
+	}
+
+	agreed := true
+	entries := make([]*raft.Log, len(logs))
+	for i := from; i <= to; i++ {
+		for j, l := range logs {
+			e, err := l.entry(i)
+			if err != nil {
+				return nil, err
+			}
+			entries[j] = e
+		}
+
+		e, count, all := largestAgreement(entries)
+		if count >= r.QuorumSize {
+			r.QuorumIndex, r.QuorumTerm = i, e.Term
+		}
+
+		if agreed && !all {
+			d := &logDivergence{Index: i, Terms: map[string]uint64{}}
+			for j, e := range entries {
+				if e != nil {
+					d.Terms[logs[j].Path] = e.Term
+				}
+			}
+			r.Divergences = append(r.Divergences, d)
+		}
+		agreed = all
+	}
+
+	return r, nil
+}
+
+// largestAgreement returns the entry held by the most servers and its count,
+// and whether all servers holding an entry agree on it.
+func largestAgreement(entries []*raft.Log) (*raft.Log, int, bool) {
+	var best *raft.Log
+	bestCount, held := 0, 0
+	for i, e := range entries {
+		if e == nil {
+			continue
+		}
+		held++
+
+		count := 0
+		for _, o := range entries[i:] {
+			if o != nil && sameEntry(e, o) {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = e, count
+		}
+	}
+
+	return best, bestCount, bestCount == held
+}
+
+func sameEntry(a, b *raft.Log) bool {
+	return a.Term == b.Term && a.Type == b.Type && bytes.Equal(a.Data, b.Data)
+}
+
+func (r *raftComparison) writeText(w *bufio.Writer) {
+	for _, l := range r.Servers {
+		fmt.Fprintf(w, "server %s: first index %d, last index %d, last term %d\n",
+			l.Path, l.FirstIndex, l.LastIndex, l.LastTerm)
+	}
+
+	if r.QuorumIndex == 0 {
+		fmt.Fprintf(w, "quorum index: none held by %d of %d servers\n", r.QuorumSize, len(r.Servers))
+	} else {
+		fmt.Fprintf(w, "quorum index: %d (term %d, held by at least %d of %d servers)\n",
+			r.QuorumIndex, r.QuorumTerm, r.QuorumSize, len(r.Servers))
+	}
+
+	for _, d := range r.Divergences {
+		terms := make([]string, 0, len(r.Servers))
+		for _, l := range r.Servers {
+			if t, ok := d.Terms[l.Path]; ok {
+				terms = append(terms, fmt.Sprintf("%s term %d", l.Path, t))
+			} else {
+				terms = append(terms, fmt.Sprintf("%s missing", l.Path))
+			}
+		}
+		fmt.Fprintf(w, "diverged at index %d: %s\n", d.Index, strings.Join(terms, ", "))
+	}
+}
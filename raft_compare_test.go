@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// testServerLog returns a server log named name holding an entry per term of
+// terms, starting at index first.  Entries are identified by their index and
+// term, so that servers holding the same term at an index agree on it.
+func testServerLog(t *testing.T, dir, name string, first uint64, terms []uint64) *serverLog {
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, name+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := make([]*raft.Log, len(terms))
+	for i, term := range terms {
+		idx := first + uint64(i)
+		logs[i] = &raft.Log{
+			Index: idx,
+			Term:  term,
+			Type:  raft.LogCommand,
+			Data:  []byte(fmt.Sprintf("%d-%d", idx, term)),
+		}
+	}
+	if len(logs) != 0 {
+		if err := store.StoreLogs(logs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := &serverLog{store: store, Path: name}
+	if len(terms) != 0 {
+		l.FirstIndex = first
+		l.LastIndex = first + uint64(len(terms)) - 1
+		l.LastTerm = terms[len(terms)-1]
+	}
+	return l
+}
+
+func TestCompareLogs(t *testing.T) {
+	type server struct {
+		first uint64
+		terms []uint64
+	}
+
+	cases := []struct {
+		name        string
+		servers     []server
+		quorumIndex uint64
+		quorumTerm  uint64
+		divergences []*logDivergence
+	}{
+		{
+			name: "all agree",
+			servers: []server{
+				{1, []uint64{1, 1, 2, 2, 2}},
+				{1, []uint64{1, 1, 2, 2, 2}},
+				{1, []uint64{1, 1, 2, 2, 2}},
+			},
+			quorumIndex: 5,
+			quorumTerm:  2,
+		},
+		{
+			name: "one lagging",
+			servers: []server{
+				{1, []uint64{1, 1, 2, 2, 2}},
+				{1, []uint64{1, 1, 2, 2, 2}},
+				{1, []uint64{1, 1, 2}},
+			},
+			quorumIndex: 5,
+			quorumTerm:  2,
+		},
+		{
+			name: "two lagging",
+			servers: []server{
+				{1, []uint64{1, 1, 2, 2, 2}},
+				{1, []uint64{1, 1, 2, 2}},
+				{1, []uint64{1, 1, 2}},
+			},
+			quorumIndex: 4,
+			quorumTerm:  2,
+		},
+		{
+			name: "compacted",
+			servers: []server{
+				{4, []uint64{2, 2, 3}},
+				{1, []uint64{1, 1, 2, 2, 2, 3}},
+				{1, []uint64{1, 1}},
+			},
+			quorumIndex: 6,
+			quorumTerm:  3,
+		},
+		{
+			name: "minority diverged",
+			servers: []server{
+				{1, []uint64{1, 1, 2, 2, 2}},
+				{1, []uint64{1, 1, 2, 2, 2}},
+				{1, []uint64{1, 1, 2, 3, 3, 3}},
+			},
+			quorumIndex: 5,
+			quorumTerm:  2,
+			divergences: []*logDivergence{
+				{Index: 4, Terms: map[string]uint64{"s0": 2, "s1": 2, "s2": 3}},
+			},
+		},
+		{
+			name: "majority diverged",
+			servers: []server{
+				{1, []uint64{1, 1, 2}},
+				{1, []uint64{1, 1, 3}},
+				{1, []uint64{1, 1, 4}},
+			},
+			quorumIndex: 2,
+			quorumTerm:  1,
+			divergences: []*logDivergence{
+				{Index: 3, Terms: map[string]uint64{"s0": 2, "s1": 3, "s2": 4}},
+			},
+		},
+		{
+			name: "diverged then agreed again",
+			servers: []server{
+				{1, []uint64{1, 2, 2}},
+				{1, []uint64{1, 3, 2}},
+				{1, []uint64{1, 2, 2, 4}},
+			},
+			quorumIndex: 3,
+			quorumTerm:  2,
+			divergences: []*logDivergence{
+				{Index: 2, Terms: map[string]uint64{"s0": 2, "s1": 3, "s2": 2}},
+			},
+		},
+		{
+			name: "no quorum",
+			servers: []server{
+				{1, []uint64{1}},
+				{1, []uint64{2}},
+				{1, []uint64{3}},
+				{1, []uint64{4}},
+			},
+			divergences: []*logDivergence{
+				{Index: 1, Terms: map[string]uint64{"s0": 1, "s1": 2, "s2": 3, "s3": 4}},
+			},
+		},
+		{
+			name: "two servers",
+			servers: []server{
+				{1, []uint64{1, 1, 1}},
+				{1, []uint64{1, 1}},
+			},
+			quorumIndex: 2,
+			quorumTerm:  1,
+		},
+		{
+			name: "empty logs",
+			servers: []server{
+				{0, nil},
+				{0, nil},
+				{0, nil},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "nomad-debug-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			logs := make([]*serverLog, len(c.servers))
+			for i, s := range c.servers {
+				logs[i] = testServerLog(t, dir, fmt.Sprintf("s%d", i), s.first, s.terms)
+				defer logs[i].store.Close()
+			}
+
+			r, err := compareLogs(logs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.QuorumSize != len(logs)/2+1 {
+				t.Errorf("expected quorum size %d but got %d", len(logs)/2+1, r.QuorumSize)
+			}
+			if r.QuorumIndex != c.quorumIndex || r.QuorumTerm != c.quorumTerm {
+				t.Errorf("expected quorum index %d term %d but got index %d term %d",
+					c.quorumIndex, c.quorumTerm, r.QuorumIndex, r.QuorumTerm)
+			}
+
+			expected := c.divergences
+			if expected == nil {
+				expected = []*logDivergence{}
+			}
+			if !reflect.DeepEqual(r.Divergences, expected) {
+				t.Errorf("expected divergences %s but got %s", formatDivergences(expected), formatDivergences(r.Divergences))
+			}
+		})
+	}
+}
+
+func formatDivergences(ds []*logDivergence) string {
+	r := make([]logDivergence, len(ds))
+	for i, d := range ds {
+		r[i] = *d
+	}
+	return fmt.Sprintf("%+v", r)
+}
+
+func TestLargestAgreement(t *testing.T) {
+	entry := func(term uint64, data string) *raft.Log {
+		return &raft.Log{Term: term, Type: raft.LogCommand, Data: []byte(data)}
+	}
+
+	cases := []struct {
+		name    string
+		entries []*raft.Log
+		term    uint64
+		count   int
+		all     bool
+	}{
+		{"none held", []*raft.Log{nil, nil, nil}, 0, 0, true},
+		{"one held", []*raft.Log{nil, entry(2, "a"), nil}, 2, 1, true},
+		{"all agree", []*raft.Log{entry(2, "a"), entry(2, "a"), entry(2, "a")}, 2, 3, true},
+		{"held ones agree", []*raft.Log{entry(2, "a"), nil, entry(2, "a")}, 2, 2, true},
+		{"majority", []*raft.Log{entry(2, "a"), entry(3, "b"), entry(3, "b")}, 3, 2, false},
+		{"all differ", []*raft.Log{entry(2, "a"), entry(3, "b"), entry(4, "c")}, 2, 1, false},
+		{"same term different data", []*raft.Log{entry(2, "a"), entry(2, "b"), entry(2, "b")}, 2, 2, false},
+		{"same data different type", []*raft.Log{
+			entry(2, "a"),
+			{Term: 2, Type: raft.LogNoop, Data: []byte("a")},
+			{Term: 2, Type: raft.LogNoop, Data: []byte("a")},
+		}, 2, 2, false},
+	}
+
+	for _, c := range cases {
+		e, count, all := largestAgreement(c.entries)
+
+		term := uint64(0)
+		if e != nil {
+			term = e.Term
+		}
+		if term != c.term || count != c.count || all != c.all {
+			t.Errorf("%s: expected (term %d, %d, %v) but got (term %d, %d, %v)",
+				c.name, c.term, c.count, c.all, term, count, all)
+		}
+	}
+}
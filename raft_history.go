@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/raft"
+)
+
+type RaftHistoryCommand struct {
+}
+
+func (a *RaftHistoryCommand) Help() string {
+	helpText := `
+Usage: nomad-debug raft history <kind> <id> <path_to_nomad_dir>
+
+  Emits the chronological list of changes to a single object, by replaying
+  the raft log and comparing the object after each applied entry.
+
+  kind is one of job, alloc, eval, node or deployment.  Jobs are identified
+  as <namespace>/<job_id>, or just <job_id> in the default namespace.
+
+Options:
+
+  --format=<format>
+    Output format: json (default), ndjson or csv.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *RaftHistoryCommand) Name() string { return "raft history" }
+
+func (c *RaftHistoryCommand) Synopsis() string {
+	return "output the history of changes to an object"
+}
+
+func (c *RaftHistoryCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *RaftHistoryCommand) run(args []string) (int, error) {
+	var fFormat string
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.StringVar(&fFormat, "format", "json", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) != 3 {
+		return 1, fmt.Errorf("expected three args but got %d", len(args))
+	}
+
+	lookup, err := objectLookup(args[0], args[1])
+	if err != nil {
+		return 1, err
+	}
+
+	dir, err := openDataDir(args[2], serverData)
+	if err != nil {
+		return 1, err
+	}
+	defer dir.Close()
+
+	r, err := newReplayer(dir)
+	if err != nil {
+		return 1, err
+	}
+	defer r.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	f, err := NewFormatter(fFormat, out, []string{"Change"})
+	if err != nil {
+		return 1, err
+	}
+
+	startIdx, err := r.earliestIndex()
+	if err != nil {
+		return 1, err
+	}
+	if err := r.replayTo(startIdx, nil); err != nil {
+		return 1, err
+	}
+
+	prev, err := lookup(r.state())
+	if err != nil {
+		return 1, err
+	}
+	if !isNil(prev) {
+		err := f.Write(&historyEntry{
+			Index:  startIdx,
+			Change: changeCreated,
+			Object: prev,
+		})
+		if err != nil {
+			return 1, fmt.Errorf("failed to encode output: %v", err)
+		}
+	}
+
+	err = r.applyTo(r.lastIdx, func(e *raft.Log) error {
+		if e.Type != raft.LogCommand {
+			return nil
+		}
+
+		cur, err := lookup(r.state())
+		if err != nil {
+			return err
+		}
+
+		d, err := diffObject(args[1], prev, cur)
+		if err != nil {
+			return err
+		}
+		prev = cur
+		if d == nil {
+			return nil
+		}
+
+		return f.Write(&historyEntry{
+			Index:       e.Index,
+			CommandType: commandType(e),
+			Change:      d.Change,
+			Object:      d.Object,
+			Fields:      d.Fields,
+		})
+	})
+	if err != nil {
+		return 1, err
+	}
+
+	if err := f.Close(); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+
+	return 0, nil
+}
+
+// historyEntry is a change to an object caused by a raft log entry.
+type historyEntry struct {
+	Index       uint64
+	CommandType string `json:",omitempty"`
+	Change      string
+
+	// Object is the created or deleted object
+	Object interface{} `json:",omitempty"`
+
+	// Fields are the changed fields of an updated object
+	Fields []fieldDiff `json:",omitempty"`
+}
+
+// objectLookup returns a function looking up the object of the given kind
+// and id in a state store.
+func objectLookup(kind, id string) (func(*state.StateStore) (interface{}, error), error) {
+	switch kind {
+	case kindJob:
+		namespace, jobID := structs.DefaultNamespace, id
+		if i := strings.Index(id, "/"); i != -1 {
+			namespace, jobID = id[:i], id[i+1:]
+		}
+		return func(s *state.StateStore) (interface{}, error) {
+			return s.JobByID(nil, namespace, jobID)
+		}, nil
+	case kindAlloc:
+		return func(s *state.StateStore) (interface{}, error) {
+			return s.AllocByID(nil, id)
+		}, nil
+	case kindEval:
+		return func(s *state.StateStore) (interface{}, error) {
+			return s.EvalByID(nil, id)
+		}, nil
+	case kindNode:
+		return func(s *state.StateStore) (interface{}, error) {
+			return s.NodeByID(nil, id)
+		}, nil
+	case kindDeployment:
+		return func(s *state.StateStore) (interface{}, error) {
+			return s.DeploymentByID(nil, id)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown object kind %q, must be one of: job, alloc, eval, node, deployment", kind)
+	}
+}
+
+// commandType returns the command type name of a raft log entry.
+func commandType(e *raft.Log) string {
+	if e.Type != raft.LogCommand || len(e.Data) == 0 {
+		return ""
+	}
+
+	msgType := structs.MessageType(e.Data[0])
+	return msgTypeNames[msgType & ^structs.IgnoreUnknownTypeFlag]
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
 )
 
 type RaftInfoCommand struct {
@@ -12,9 +18,17 @@ type RaftInfoCommand struct {
 
 func (a *RaftInfoCommand) Help() string {
 	helpText := `
-Usage: nomad-debug info logs <path_to_nomad_dir>
+Usage: nomad-debug raft info <path_to_nomad_dir>
+
+  Emits some info about the raft logs: their bounds, the stable store terms
+  and vote, the latest raft configuration, the first index of each term, the
+  count of entries per command type, the snapshots and the BoltDB page and
+  freelist statistics.  Snapshot CRCs aren't checked; see 'raft snapshots'.
 
-  Emits some info about the raft logs.
+Options:
+
+  --format=<format>
+    Output format: text (default), json, ndjson or csv.
 `
 
 	return strings.TrimSpace(helpText)
@@ -27,23 +41,311 @@ func (c *RaftInfoCommand) Synopsis() string {
 }
 
 func (c *RaftInfoCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *RaftInfoCommand) run(args []string) (int, error) {
+	var fFormat string
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.StringVar(&fFormat, "format", "text", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
 	if len(args) != 1 {
-		return 1
+		return 1, fmt.Errorf("expected one arg but got %d", len(args))
+	}
+
+	dir, err := openDataDir(args[0], serverData)
+	if err != nil {
+		return 1, err
 	}
+	defer dir.Close()
 
-	p := filepath.Join(args[0], "server", "raft", "raft.db")
+	p := dir.raftDB
 
 	store, firstIdx, lastIdx, err := raftState(p)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to open raft logs: %v\n", err)
-		return 1
+		return 1, fmt.Errorf("failed to open raft logs: %v", err)
 	}
 	defer store.Close()
 
-	fmt.Println("path:        ", p)
-	fmt.Println("length:      ", lastIdx-firstIdx+1)
-	fmt.Println("first index: ", firstIdx)
-	fmt.Println("last index:  ", lastIdx)
+	info := &raftInfo{
+		Path:       p,
+		Length:     lastIdx - firstIdx + 1,
+		FirstIndex: firstIdx,
+		LastIndex:  lastIdx,
+	}
+
+	if err := info.readStableStore(store); err != nil {
+		return 1, err
+	}
+	if err := info.readLogs(store); err != nil {
+		return 1, err
+	}
+	if err := info.readSnapshots(dir.raftDir); err != nil {
+		return 1, err
+	}
+	if err := info.readBolt(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read bolt stats, skipping them: %v\n", err)
+	}
+
+	if fFormat == "text" {
+		info.printText()
+		return 0, nil
+	}
+
+	f, err := NewFormatter(fFormat, os.Stdout, []string{"Info"})
+	if err != nil {
+		return 1, err
+	}
+	if err := f.Write(info); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+
+	return 0, nil
+}
+
+type raftInfo struct {
+	Path       string
+	Length     uint64
+	FirstIndex uint64
+	LastIndex  uint64
+
+	CurrentTerm  uint64
+	LastVoteTerm uint64
+	LastVoteCand string
+
+	// Configuration is the latest raft configuration found in the log, or
+	// in the latest snapshot if the log holds none
+	ConfigurationIndex uint64
+	Configuration      raft.Configuration
+
+	Terms         []*termBoundary
+	CommandCounts map[string]int
+
+	Snapshots []*snapshotInfo
+
+	// Bolt holds the BoltDB statistics, or nil if they couldn't be read
+	Bolt *boltInfo `json:",omitempty"`
+}
+
+// termBoundary is the first index of a term found in the log.
+type termBoundary struct {
+	Term       uint64
+	FirstIndex uint64
+}
+
+type boltInfo struct {
+	Size     int64
+	PageSize int
+
+	FreePageN     int
+	PendingPageN  int
+	FreeAlloc     int
+	FreelistInuse int
+
+	Buckets map[string]bolt.BucketStats
+}
+
+func (info *raftInfo) readStableStore(store *raftboltdb.BoltStore) error {
+	var err error
+	for k, v := range map[string]*uint64{"CurrentTerm": &info.CurrentTerm, "LastVoteTerm": &info.LastVoteTerm} {
+		*v, err = store.GetUint64([]byte(k))
+		if err != nil && err != raftboltdb.ErrKeyNotFound {
+			return fmt.Errorf("failed to read %s: %v", k, err)
+		}
+	}
+
+	cand, err := store.Get([]byte("LastVoteCand"))
+	if err != nil && err != raftboltdb.ErrKeyNotFound {
+		return fmt.Errorf("failed to read LastVoteCand: %v", err)
+	}
+	info.LastVoteCand = string(cand)
+
+	return nil
+}
+
+// readLogs walks the log, collecting the term boundaries, the command counts
+// and the latest configuration.
+func (info *raftInfo) readLogs(store *raftboltdb.BoltStore) error {
+	info.Terms = []*termBoundary{}
+	info.CommandCounts = map[string]int{}
+
+	if info.LastIndex == 0 {
+		return nil
+	}
+
+	for i := info.FirstIndex; i <= info.LastIndex; i++ {
+		var e raft.Log
+		if err := store.GetLog(i, &e); err != nil {
+			return fmt.Errorf("failed to read log entry at index %d: %v", i, err)
+		}
+
+		if n := len(info.Terms); n == 0 || info.Terms[n-1].Term != e.Term {
+			info.Terms = append(info.Terms, &termBoundary{Term: e.Term, FirstIndex: i})
+		}
+
+		info.CommandCounts[commandName(&e)]++
+
+		if e.Type == raft.LogConfiguration {
+			info.Configuration = raft.DecodeConfiguration(e.Data)
+			info.ConfigurationIndex = i
+		}
+	}
+
+	return nil
+}
+
+// commandName returns the command type of command entries, or the log type of
+// other entries.
+func commandName(e *raft.Log) string {
+	if e.Type != raft.LogCommand || len(e.Data) == 0 {
+		if n, ok := logTypes[e.Type]; ok {
+			return n
+		}
+		return fmt.Sprintf("%d", e.Type)
+	}
+
+	msgType := structs.MessageType(e.Data[0]) & ^structs.IgnoreUnknownTypeFlag
+	if n, ok := msgTypeNames[msgType]; ok {
+		return n
+	}
+	return fmt.Sprintf("%d", msgType)
+}
+
+func (info *raftInfo) readSnapshots(raftDir string) error {
+	snaps, err := openSnapshotStore(raftDir)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := snaps.List()
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %v", err)
+	}
+
+	info.Snapshots = make([]*snapshotInfo, 0, len(snapshots))
+	for _, s := range snapshots {
+		info.Snapshots = append(info.Snapshots, newSnapshotInfo(snaps, s, false))
+	}
 
-	return 0
+	// snapshots are listed newest first
+	if info.ConfigurationIndex == 0 && len(snapshots) != 0 {
+		info.Configuration = snapshots[0].Configuration
+		info.ConfigurationIndex = snapshots[0].ConfigurationIndex
+	}
+
+	return nil
+}
+
+// readBolt reads the BoltDB statistics of the raft.db file, opened read-only
+// a second time, as raftboltdb doesn't expose its bolt database.
+func (info *raftInfo) readBolt() error {
+	db, err := bolt.Open(info.Path, 0600, &bolt.Options{ReadOnly: true, Timeout: boltLockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats := db.Stats()
+	bi := &boltInfo{
+		PageSize:      db.Info().PageSize,
+		FreePageN:     stats.FreePageN,
+		PendingPageN:  stats.PendingPageN,
+		FreeAlloc:     stats.FreeAlloc,
+		FreelistInuse: stats.FreelistInuse,
+		Buckets:       map[string]bolt.BucketStats{},
+	}
+
+	if fi, err := os.Stat(info.Path); err == nil {
+		bi.Size = fi.Size()
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			bi.Buckets[string(name)] = b.Stats()
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	info.Bolt = bi
+	return nil
+}
+
+func (info *raftInfo) printText() {
+	fmt.Println("path:           ", info.Path)
+	fmt.Println("length:         ", info.Length)
+	fmt.Println("first index:    ", info.FirstIndex)
+	fmt.Println("last index:     ", info.LastIndex)
+	fmt.Println("current term:   ", info.CurrentTerm)
+	fmt.Println("last vote term: ", info.LastVoteTerm)
+	fmt.Println("last vote cand: ", info.LastVoteCand)
+
+	fmt.Println()
+	fmt.Println("configuration at index", info.ConfigurationIndex)
+	for _, s := range info.Configuration.Servers {
+		fmt.Printf("  %v %v %v\n", s.ID, s.Address, s.Suffrage)
+	}
+
+	fmt.Println()
+	fmt.Println("terms")
+	for _, t := range info.Terms {
+		fmt.Printf("  term %d starts at index %d\n", t.Term, t.FirstIndex)
+	}
+
+	fmt.Println()
+	fmt.Println("entries")
+	names := make([]string, 0, len(info.CommandCounts))
+	for n := range info.CommandCounts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Printf("  %-40s %d\n", n, info.CommandCounts[n])
+	}
+
+	fmt.Println()
+	fmt.Println("snapshots")
+	for _, s := range info.Snapshots {
+		fmt.Printf("  %v index %d term %d size %d\n", s.ID, s.Index, s.Term, s.Size)
+	}
+
+	if info.Bolt == nil {
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("bolt")
+	fmt.Println("  size:           ", info.Bolt.Size)
+	fmt.Println("  page size:      ", info.Bolt.PageSize)
+	fmt.Println("  free pages:     ", info.Bolt.FreePageN)
+	fmt.Println("  pending pages:  ", info.Bolt.PendingPageN)
+	fmt.Println("  free alloc:     ", info.Bolt.FreeAlloc)
+	fmt.Println("  freelist inuse: ", info.Bolt.FreelistInuse)
+
+	buckets := make([]string, 0, len(info.Bolt.Buckets))
+	for n := range info.Bolt.Buckets {
+		buckets = append(buckets, n)
+	}
+	sort.Strings(buckets)
+	for _, n := range buckets {
+		b := info.Bolt.Buckets[n]
+		fmt.Printf("  bucket %s: %d keys, depth %d, %d branch pages, %d leaf pages, %d overflow leaf pages\n",
+			n, b.KeyN, b.Depth, b.BranchPageN, b.LeafPageN, b.LeafOverflowN)
+	}
 }
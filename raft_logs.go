@@ -3,12 +3,15 @@ package main
 //go:generate ./generate_msgtypes.sh
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/nomad/nomad/structs"
@@ -24,6 +27,40 @@ func (a *RaftLogsCommand) Help() string {
 Usage: nomad-debug raft logs <path_to_nomad_dir>
 
   Emits the raft logs content in json form.
+
+  Entries are written as soon as they are decoded, so the output can be piped
+  into jq or head without waiting for the whole log to be read.
+
+Options:
+
+  --from-index=<from_index>
+    First log index to emit. If passed from_index is negative, it's perceived
+    as an offset from the last index seen in raft.
+
+  --to-index=<to_index>
+    Last log index to emit. If passed to_index is zero or negative, it's
+    perceived as an offset from the last index seen in raft.
+
+  --tail=<n>
+    Emit only the last n entries up to to_index.
+
+  --type=<command_type>[,<command_type>...]
+    Emit only entries of the given command types, e.g.
+    AllocClientUpdateRequestType.
+
+  --job=<job_id>
+  --node=<node_id>
+  --alloc=<alloc_id>
+  --eval=<eval_id>
+  --deployment=<deployment_id>
+    Emit only entries referencing the given object.  Node, allocation,
+    evaluation and deployment IDs may be a prefix of the full ID.
+
+  --format=<format>
+    Output format: json (default), ndjson or csv.
+
+  --stream
+    Shorthand for --format=ndjson, emitting one json object per line.
 `
 
 	return strings.TrimSpace(helpText)
@@ -36,20 +73,81 @@ func (c *RaftLogsCommand) Synopsis() string {
 }
 
 func (c *RaftLogsCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *RaftLogsCommand) run(args []string) (int, error) {
+	var fFromIdx, fToIdx int64
+	var fTail uint64
+	var fStream bool
+	var fFormat, fType string
+	fIDs := map[string]*string{}
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.Int64Var(&fFromIdx, "from-index", 0, "")
+	flags.Int64Var(&fToIdx, "to-index", 0, "")
+	flags.Uint64Var(&fTail, "tail", 0, "")
+	flags.BoolVar(&fStream, "stream", false, "")
+	flags.StringVar(&fFormat, "format", "json", "")
+	flags.StringVar(&fType, "type", "", "")
+	for _, kind := range []string{kindJob, kindNode, kindAlloc, kindEval, kindDeployment} {
+		fIDs[kind] = flags.String(kind, "", "")
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
 	if len(args) != 1 {
-		return 1
+		return 1, fmt.Errorf("expected one arg but got %d", len(args))
+	}
+
+	if fTail != 0 && fFromIdx != 0 {
+		return 1, fmt.Errorf("--tail and --from-index are mutually exclusive")
 	}
 
-	p := filepath.Join(args[0], "server", "raft", "raft.db")
+	ids := make(map[string]string, len(fIDs))
+	for kind, id := range fIDs {
+		ids[kind] = *id
+	}
+	filter, err := newLogFilter(fType, ids)
+	if err != nil {
+		return 1, err
+	}
+
+	dir, err := openDataDir(args[0], serverData)
+	if err != nil {
+		return 1, err
+	}
+	defer dir.Close()
+
+	p := dir.raftDB
 
 	store, firstIdx, lastIdx, err := raftState(p)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to open raft logs: %v\n", err)
-		return 1
+		return 1, fmt.Errorf("failed to open raft logs: %v", err)
 	}
 	defer store.Close()
 
-	arr := make([]*logMessage, 0, lastIdx-firstIdx+1)
+	firstIdx, lastIdx = logRange(firstIdx, lastIdx, fFromIdx, fToIdx, fTail)
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	if fStream {
+		fFormat = "ndjson"
+	}
+	f, err := NewFormatter(fFormat, out, []string{"Entry"})
+	if err != nil {
+		return 1, err
+	}
+
 	for i := firstIdx; i <= lastIdx; i++ {
 		var e raft.Log
 		err := store.GetLog(i, &e)
@@ -66,21 +164,54 @@ func (c *RaftLogsCommand) Run(args []string) int {
 			//return 1
 		}
 
-		arr = append(arr, m)
+		if !filter.match(m) {
+			continue
+		}
+
+		if err := f.Write(m); err != nil {
+			return 1, fmt.Errorf("failed to encode output: %v", err)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+
+	return 0, nil
+}
+
+// logRange narrows the [firstIdx, lastIdx] range of the raft log to the one
+// requested on the command line.
+func logRange(firstIdx, lastIdx uint64, cliFromIdx, cliToIdx int64, tail uint64) (uint64, uint64) {
+	to := lastIndex(lastIdx, cliToIdx)
+
+	from := firstIdx
+	switch {
+	case tail != 0:
+		if to >= tail {
+			from = to - tail + 1
+		} else {
+			from = 0
+		}
+	case cliFromIdx < 0:
+		if lastIdx > uint64(-cliFromIdx) {
+			from = lastIdx - uint64(-cliFromIdx)
+		} else {
+			from = 0
+		}
+	case cliFromIdx > 0:
+		from = uint64(cliFromIdx)
 	}
 
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(arr); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to encode output: %v\n", err)
-		return 1
+	if from < firstIdx {
+		from = firstIdx
 	}
 
-	return 0
+	return from, to
 }
 
 func raftState(p string) (store *raftboltdb.BoltStore, firstIdx uint64, lastIdx uint64, err error) {
-	s, err := raftboltdb.NewBoltStore(p)
+	s, err := openRaftStore(p)
 	if err != nil {
 		return nil, 0, 0, fmt.Errorf("failed to open raft logs: %v", err)
 	}
@@ -108,6 +239,42 @@ type logMessage struct {
 	Body                  interface{} `json:",omitempty"`
 }
 
+func (m *logMessage) csvHeaders() []string {
+	return []string{
+		"Index", "Term", "LogType", "CommandType", "Namespace",
+		"JobIDs", "NodeIDs", "AllocIDs", "EvalIDs", "DeploymentIDs",
+		"Timestamp", "Body",
+	}
+}
+
+func (m *logMessage) csvRow() ([]string, error) {
+	body, err := json.Marshal(m.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := bodyIDs(m.Body)
+	timestamp := ""
+	if t, ok := entryTime(m.Body); ok {
+		timestamp = t.UTC().Format(time.RFC3339Nano)
+	}
+
+	return []string{
+		strconv.FormatUint(m.Index, 10),
+		strconv.FormatUint(m.Term, 10),
+		m.LogType,
+		m.CommandType,
+		strings.Join(ids.sorted(kindNamespace), " "),
+		strings.Join(ids.sorted(kindJob), " "),
+		strings.Join(ids.sorted(kindNode), " "),
+		strings.Join(ids.sorted(kindAlloc), " "),
+		strings.Join(ids.sorted(kindEval), " "),
+		strings.Join(ids.sorted(kindDeployment), " "),
+		timestamp,
+		string(body),
+	}, nil
+}
+
 func decode(e *raft.Log) (*logMessage, error) {
 	m := &logMessage{
 		LogType: logTypes[e.Type],
@@ -120,12 +287,13 @@ func decode(e *raft.Log) (*logMessage, error) {
 	}
 
 	var data []byte
+	var msgType structs.MessageType
 	if e.Type == raft.LogCommand {
 		if len(e.Data) == 0 {
 			return nil, fmt.Errorf("command did not include data")
 		}
 
-		msgType := structs.MessageType(e.Data[0])
+		msgType = structs.MessageType(e.Data[0])
 
 		m.CommandType = msgTypeNames[msgType & ^structs.IgnoreUnknownTypeFlag]
 		m.IgnoreUnknownTypeFlag = (msgType & structs.IgnoreUnknownTypeFlag) != 0
@@ -136,31 +304,58 @@ func decode(e *raft.Log) (*logMessage, error) {
 	}
 
 	if len(data) != 0 {
-		decoder := codec.NewDecoder(bytes.NewReader(data), MsgpackHandle)
-
 		var v interface{}
 		var err error
-		if m.CommandType == msgTypeNames[structs.JobBatchDeregisterRequestType] {
-			var vr structs.JobBatchDeregisterRequest
-			err = decoder.Decode(&vr)
-			v = jsonifyJobBatchDeregisterRequest(&vr)
-		} else {
-			var vr interface{}
-			err = decoder.Decode(&vr)
-			v = vr
+
+		newBody, typed := msgTypeBodies[msgType & ^structs.IgnoreUnknownTypeFlag]
+		if e.Type == raft.LogCommand && typed {
+			v, err = decodeTyped(data, newBody())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to decode log entry at index %d: failed to decode typed body of %v, falling back to generic decoding: %v\n", e.Index, m.CommandType, err)
+				typed = false
+			}
+		}
+
+		if e.Type != raft.LogCommand || !typed {
+			v, err = decodeGeneric(data)
 		}
 
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to decode log entry at index %d: failed to decode body of %v.%v %v\n", e.Index, e.Type, m.CommandType, err)
 			v = "FAILED TO DECODE DATA"
 		}
-		fixTime(v)
 		m.Body = v
 	}
 
 	return m, nil
 }
 
+// decodeTyped decodes a raft command body into its request struct, the same
+// way the nomad server FSM does.
+func decodeTyped(data []byte, v interface{}) (interface{}, error) {
+	if err := structs.Decode(data, v); err != nil {
+		return nil, err
+	}
+
+	if vr, ok := v.(*structs.JobBatchDeregisterRequest); ok {
+		return jsonifyJobBatchDeregisterRequest(vr), nil
+	}
+	return v, nil
+}
+
+// decodeGeneric decodes a msgpack body without knowledge of its type,
+// recovering timestamps heuristically.
+func decodeGeneric(data []byte) (interface{}, error) {
+	var v interface{}
+	err := codec.NewDecoder(bytes.NewReader(data), MsgpackHandle).Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	fixTime(v)
+	return v, nil
+}
+
 func jsonifyJobBatchDeregisterRequest(v *structs.JobBatchDeregisterRequest) interface{} {
 	var data struct {
 		Jobs  map[string]*structs.JobDeregisterOptions
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestLogRange(t *testing.T) {
+	cases := []struct {
+		name     string
+		first    uint64
+		last     uint64
+		cliFrom  int64
+		cliTo    int64
+		tail     uint64
+		from, to uint64
+	}{
+		{"whole log", 10, 100, 0, 0, 0, 10, 100},
+		{"from", 10, 100, 50, 0, 0, 50, 100},
+		{"from before first", 10, 100, 5, 0, 0, 10, 100},
+		{"negative from", 10, 100, -20, 0, 0, 80, 100},
+		{"negative from before first", 10, 100, -95, 0, 0, 10, 100},
+		{"negative from beyond zero", 10, 100, -200, 0, 0, 10, 100},
+		{"to", 10, 100, 0, 60, 0, 10, 60},
+		{"to after last", 10, 100, 0, 200, 0, 10, 100},
+		{"negative to", 10, 100, 0, -10, 0, 10, 90},
+		{"from and to", 10, 100, 20, 30, 0, 20, 30},
+		{"negative from and to", 10, 100, -20, -10, 0, 80, 90},
+		{"tail", 10, 100, 0, 0, 5, 96, 100},
+		{"tail and to", 10, 100, 0, 60, 5, 56, 60},
+		{"tail and negative to", 10, 100, 0, -10, 5, 86, 90},
+		{"tail overrides from", 10, 100, 20, 0, 5, 96, 100},
+		{"tail beyond first", 10, 100, 0, 0, 95, 10, 100},
+		{"tail beyond zero", 10, 100, 0, 0, 500, 10, 100},
+		{"empty log", 0, 0, 0, 0, 0, 0, 0},
+		{"empty log tail", 0, 0, 0, 0, 5, 0, 0},
+	}
+
+	for _, c := range cases {
+		from, to := logRange(c.first, c.last, c.cliFrom, c.cliTo, c.tail)
+		if from != c.from || to != c.to {
+			t.Errorf("%s: logRange(%d, %d, %d, %d, %d): expected [%d, %d] but got [%d, %d]",
+				c.name, c.first, c.last, c.cliFrom, c.cliTo, c.tail, c.from, c.to, from, to)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad"
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// stateFSM is the nomad server FSM, whose concrete type is unexported.
+type stateFSM interface {
+	raft.FSM
+	State() *state.StateStore
+}
+
+// newFSM returns a nomad server FSM using dummy non-enabled dependencies.
+func newFSM() (stateFSM, error) {
+	logger := hclog.L()
+
+	// use dummy non-enabled FSM depedencies
+	periodicDispatch := nomad.NewPeriodicDispatch(logger, nil)
+	blockedEvals := nomad.NewBlockedEvals(nil, logger)
+	evalBroker, err := nomad.NewEvalBroker(1, 1, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	fsmConfig := &nomad.FSMConfig{
+		EvalBroker: evalBroker,
+		Periodic:   periodicDispatch,
+		Blocked:    blockedEvals,
+		Logger:     logger,
+		Region:     "default",
+	}
+
+	return nomad.NewFSM(fsmConfig)
+}
+
+// replayer rebuilds the nomad server state of a data dir, by restoring a raft
+// snapshot and applying the raft log entries following it.
+type replayer struct {
+	store *raftboltdb.BoltStore
+	snaps raft.SnapshotStore
+	fsm   stateFSM
+
+	// firstIdx and lastIdx are the bounds of the raft log
+	firstIdx uint64
+	lastIdx  uint64
+
+	// appliedIdx and appliedTerm are the index and term of the last entry
+	// applied to the fsm
+	appliedIdx  uint64
+	appliedTerm uint64
+
+	// config is the raft configuration as of the last applied entry, and
+	// configIdx the index it was set at
+	config    raft.Configuration
+	configIdx uint64
+}
+
+func newReplayer(dir *dataDir) (*replayer, error) {
+	store, firstIdx, lastIdx, err := raftState(dir.raftDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft logs: %v", err)
+	}
+
+	snaps, err := openSnapshotStore(dir.raftDir)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return &replayer{
+		store:    store,
+		snaps:    snaps,
+		firstIdx: firstIdx,
+		lastIdx:  lastIdx,
+	}, nil
+}
+
+func (r *replayer) Close() error {
+	return r.store.Close()
+}
+
+func (r *replayer) state() *state.StateStore {
+	return r.fsm.State()
+}
+
+// replayTo rebuilds a fresh fsm from the nearest snapshot preceding idx, and
+// applies log entries up to idx.  fn, if not nil, is called after every
+// applied entry.
+func (r *replayer) replayTo(idx uint64, fn func(e *raft.Log) error) error {
+	fsm, err := newFSM()
+	if err != nil {
+		return err
+	}
+
+	// restore from snapshot first
+	meta, err := restoreFromSnapshot(fsm, r.snaps, idx)
+	if err != nil {
+		return err
+	}
+
+	r.fsm = fsm
+	r.appliedIdx, r.appliedTerm = 0, 0
+	r.config, r.configIdx = raft.Configuration{}, 0
+	if meta != nil {
+		r.appliedIdx, r.appliedTerm = meta.Index, meta.Term
+		r.config, r.configIdx = meta.Configuration, meta.ConfigurationIndex
+	}
+
+	if r.appliedIdx+1 < r.firstIdx {
+		return fmt.Errorf("missing logs after snapshot [%v,%v]", r.appliedIdx+1, r.firstIdx-1)
+	}
+
+	return r.applyTo(idx, fn)
+}
+
+// applyTo applies log entries following the last applied one up to idx.
+// fn, if not nil, is called after every applied entry.
+func (r *replayer) applyTo(idx uint64, fn func(e *raft.Log) error) error {
+	if idx > r.lastIdx {
+		idx = r.lastIdx
+	}
+
+	for i := r.appliedIdx + 1; i <= idx; i++ {
+		var e raft.Log
+		err := r.store.GetLog(i, &e)
+		if err != nil {
+			return fmt.Errorf("failed to read log entry at index %d: %v", i, err)
+		}
+
+		switch e.Type {
+		case raft.LogCommand:
+			r.fsm.Apply(&e)
+		case raft.LogConfiguration:
+			r.config = raft.DecodeConfiguration(e.Data)
+			r.configIdx = i
+		}
+		r.appliedIdx, r.appliedTerm = i, e.Term
+
+		if fn != nil {
+			if err := fn(&e); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// indexAtTime returns the index of the last log entry preceding the first
+// entry with a timestamp after t.  Timestamps are derived from the objects
+// found in decoded entries, see entryTime.
+func (r *replayer) indexAtTime(t time.Time) (uint64, error) {
+	idx := uint64(0)
+	for i := r.firstIdx; i <= r.lastIdx; i++ {
+		var e raft.Log
+		err := r.store.GetLog(i, &e)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read log entry at index %d: %v", i, err)
+		}
+
+		m, err := decode(&e)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode log entry at index %d: %v", i, err)
+		}
+
+		if et, ok := entryTime(m.Body); ok && et.After(t) {
+			break
+		}
+		idx = i
+	}
+
+	if idx == 0 {
+		return 0, fmt.Errorf("no raft log entries found before %v", t)
+	}
+	return idx, nil
+}
+
+// earliestIndex returns the earliest index the state can be rebuilt at: the
+// oldest snapshot followed by the available logs, or zero if the raft log
+// starts at the beginning.
+func (r *replayer) earliestIndex() (uint64, error) {
+	if r.firstIdx <= 1 {
+		return 0, nil
+	}
+
+	snapshots, err := r.snaps.List()
+	if err != nil {
+		return 0, err
+	}
+
+	// snapshots are listed newest first
+	idx := uint64(0)
+	for _, snapshot := range snapshots {
+		if snapshot.Index+1 >= r.firstIdx {
+			idx = snapshot.Index
+		}
+	}
+
+	if idx == 0 {
+		return 0, fmt.Errorf("missing logs before first index %v", r.firstIdx)
+	}
+	return idx, nil
+}
+
+// restoreFromSnapshot restores the latest snapshot that isn't past maxIdx,
+// and returns its metadata, or nil if no snapshot was restored.
+func restoreFromSnapshot(fsm raft.FSM, snaps raft.SnapshotStore, maxIdx uint64) (*raft.SnapshotMeta, error) {
+	snapshots, err := snaps.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Index > maxIdx {
+			continue
+		}
+
+		_, source, err := snaps.Open(snapshot.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open snapshot %v: %v\n", snapshot.ID, err)
+			continue
+		}
+
+		err = fsm.Restore(source)
+		source.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to restore source %v: %v\n", snapshot.ID, err)
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "restored snapshot %v at index %d\n", snapshot.ID, snapshot.Index)
+		return snapshot, nil
+	}
+
+	return nil, nil
+}
+
+// saveSnapshot writes the fsm state, as of the last applied entry, into a
+// snapshot archive at p.
+func (r *replayer) saveSnapshot(p string) (*raft.SnapshotMeta, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	meta := &raft.SnapshotMeta{
+		Version:            raft.SnapshotVersionMax,
+		ID:                 fmt.Sprintf("%d-%d-%d", r.appliedTerm, r.appliedIdx, now),
+		Index:              r.appliedIdx,
+		Term:               r.appliedTerm,
+		Configuration:      r.config,
+		ConfigurationIndex: r.configIdx,
+	}
+
+	if err := saveSnapshotArchive(r.fsm, meta, p); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// replayState builds the server state store found in the nomad data dir, by
+// replaying the raft log up to cliLastIdx, as interpreted by lastIndex.
+func replayState(dir *dataDir, cliLastIdx int64) (*state.StateStore, error) {
+	r, err := newReplayer(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if err := r.replayTo(lastIndex(r.lastIdx, cliLastIdx), nil); err != nil {
+		return nil, err
+	}
+
+	return r.state(), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// stableStoreKeys are the raft stable store keys copied by raft rewrite.
+var stableStoreKeys = []string{"CurrentTerm", "LastVoteTerm", "LastVoteCand"}
+
+// rewriteBatchSize is the number of log entries stored per transaction.
+const rewriteBatchSize = 1000
+
+type RaftRewriteCommand struct {
+}
+
+func (a *RaftRewriteCommand) Help() string {
+	helpText := `
+Usage: nomad-debug raft rewrite [options] <path_to_raft.db> <out_raft.db>
+
+  Copies the raft log and stable store of a raft.db file into a new file,
+  with some entries dropped or truncated, e.g. to get rid of a transaction
+  that crashes the FSM.  The source file is opened read-only and never
+  modified, and the output file must not exist.
+
+  Dropped entries are replaced by no-op entries of the same index and term,
+  so that the log remains contiguous.  Dropping a configuration entry, i.e.
+  a change of the cluster membership, is refused unless
+  --drop-configuration is passed, as raft would then restore the peer set
+  of the preceding configuration.
+
+  The snapshots found next to the raft.db file aren't rewritten; truncating
+  the log before the latest snapshot index doesn't undo the snapshot.
+
+Options:
+
+  --drop-index=<index>[,<index>...]
+    Replace the entries at the given indexes with no-op entries.
+
+  --truncate-after=<index>
+    Drop all entries following the given index.
+
+  --drop-configuration
+    Allow --drop-index to drop configuration entries.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *RaftRewriteCommand) Name() string { return "raft rewrite" }
+
+func (c *RaftRewriteCommand) Synopsis() string {
+	return "copy raft log with entries dropped or truncated"
+}
+
+func (c *RaftRewriteCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *RaftRewriteCommand) run(args []string) (int, error) {
+	var fDropIdx string
+	var fTruncateAfter uint64
+	var fDropConfig bool
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.StringVar(&fDropIdx, "drop-index", "", "")
+	flags.Uint64Var(&fTruncateAfter, "truncate-after", 0, "")
+	flags.BoolVar(&fDropConfig, "drop-configuration", false, "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) != 2 {
+		return 1, fmt.Errorf("expected two args but got %d", len(args))
+	}
+
+	drop := map[uint64]bool{}
+	if fDropIdx != "" {
+		for _, s := range strings.Split(fDropIdx, ",") {
+			idx, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return 1, fmt.Errorf("failed to parse --drop-index: %v", err)
+			}
+			drop[idx] = true
+		}
+	}
+
+	if len(drop) == 0 && fTruncateAfter == 0 {
+		return 1, fmt.Errorf("expected --drop-index or --truncate-after")
+	}
+
+	in, out := args[0], args[1]
+	if _, err := os.Stat(out); err == nil {
+		return 1, fmt.Errorf("output file %s already exists", out)
+	} else if !os.IsNotExist(err) {
+		return 1, err
+	}
+
+	dir, err := openDataDir(in, serverData)
+	if err != nil {
+		return 1, err
+	}
+	defer dir.Close()
+
+	src, err := openRaftStore(dir.raftDB)
+	if err != nil {
+		return 1, fmt.Errorf("failed to open raft logs: %v", err)
+	}
+	defer src.Close()
+
+	dst, err := raftboltdb.NewBoltStore(out)
+	if err != nil {
+		return 1, fmt.Errorf("failed to create output raft logs: %v", err)
+	}
+
+	stats, err := rewriteLogs(src, dst, drop, fTruncateAfter, fDropConfig)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return 1, err
+	}
+
+	fmt.Fprintf(os.Stderr, "copied %d entries, dropped %d and truncated %d\n",
+		stats.copied, stats.dropped, stats.truncated)
+	return 0, nil
+}
+
+type rewriteStats struct {
+	copied    int
+	dropped   int
+	truncated int
+}
+
+// rewriteLogs copies the stable store keys and the log entries of src into
+// dst, replacing the entries in drop with no-op entries, and dropping the
+// entries following truncateAfter if not zero.  Configuration entries are
+// only dropped if dropConfig is set.
+func rewriteLogs(src, dst *raftboltdb.BoltStore, drop map[uint64]bool, truncateAfter uint64, dropConfig bool) (*rewriteStats, error) {
+	for _, k := range stableStoreKeys {
+		v, err := src.Get([]byte(k))
+		if err == raftboltdb.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", k, err)
+		}
+
+		if err := dst.Set([]byte(k), v); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", k, err)
+		}
+	}
+
+	firstIdx, err := src.FirstIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch first index: %v", err)
+	}
+	lastIdx, err := src.LastIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch last index: %v", err)
+	}
+
+	stats := &rewriteStats{}
+	if truncateAfter != 0 && truncateAfter < lastIdx {
+		if truncateAfter < firstIdx {
+			return nil, fmt.Errorf("--truncate-after %d precedes the first raft index %d", truncateAfter, firstIdx)
+		}
+		stats.truncated = int(lastIdx - truncateAfter)
+		lastIdx = truncateAfter
+	}
+
+	for idx := range drop {
+		if idx < firstIdx || idx > lastIdx {
+			return nil, fmt.Errorf("--drop-index %d is outside the raft log [%d,%d]", idx, firstIdx, lastIdx)
+		}
+	}
+
+	if lastIdx == 0 {
+		return stats, nil
+	}
+
+	batch := make([]*raft.Log, 0, rewriteBatchSize)
+	for i := firstIdx; i <= lastIdx; i++ {
+		var e raft.Log
+		if err := src.GetLog(i, &e); err != nil {
+			return nil, fmt.Errorf("failed to read log entry at index %d: %v", i, err)
+		}
+
+		if drop[i] {
+			if e.Type == raft.LogConfiguration && !dropConfig {
+				return nil, fmt.Errorf("entry at index %d is a configuration change, dropping it requires --drop-configuration", i)
+			}
+			e = raft.Log{Index: e.Index, Term: e.Term, Type: raft.LogNoop}
+			stats.dropped++
+		} else {
+			stats.copied++
+		}
+
+		batch = append(batch, &e)
+		if len(batch) == cap(batch) || i == lastIdx {
+			if err := dst.StoreLogs(batch); err != nil {
+				return nil, fmt.Errorf("failed to write log entries: %v", err)
+			}
+			batch = batch[:0]
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+func TestRewriteLogs(t *testing.T) {
+	// the source log holds entries 11 to 20, with a configuration entry at 15
+	entries := make([]*raft.Log, 0, 10)
+	for i := uint64(11); i <= 20; i++ {
+		e := &raft.Log{Index: i, Term: 2, Type: raft.LogCommand, Data: []byte{byte(i)}}
+		if i == 15 {
+			e.Type = raft.LogConfiguration
+		}
+		entries = append(entries, e)
+	}
+
+	cases := []struct {
+		name          string
+		drop          []uint64
+		truncateAfter uint64
+		dropConfig    bool
+
+		first, last uint64
+		dropped     []uint64
+		err         string
+	}{
+		{
+			name:  "copy",
+			first: 11,
+			last:  20,
+		},
+		{
+			name:    "drop",
+			drop:    []uint64{12, 17},
+			first:   11,
+			last:    20,
+			dropped: []uint64{12, 17},
+		},
+		{
+			name:          "truncate",
+			truncateAfter: 18,
+			first:         11,
+			last:          18,
+		},
+		{
+			name:          "truncate past last",
+			truncateAfter: 30,
+			first:         11,
+			last:          20,
+		},
+		{
+			name:          "drop and truncate",
+			drop:          []uint64{11},
+			truncateAfter: 13,
+			first:         11,
+			last:          13,
+			dropped:       []uint64{11},
+		},
+		{
+			name: "drop before first",
+			drop: []uint64{10},
+			err:  "--drop-index 10 is outside the raft log [11,20]",
+		},
+		{
+			name:          "drop truncated",
+			drop:          []uint64{19},
+			truncateAfter: 18,
+			err:           "--drop-index 19 is outside the raft log [11,18]",
+		},
+		{
+			name:          "truncate before first",
+			truncateAfter: 5,
+			err:           "--truncate-after 5 precedes the first raft index 11",
+		},
+		{
+			name: "drop configuration",
+			drop: []uint64{15},
+			err:  "entry at index 15 is a configuration change",
+		},
+		{
+			name:       "drop configuration allowed",
+			drop:       []uint64{15},
+			dropConfig: true,
+			first:      11,
+			last:       20,
+			dropped:    []uint64{15},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "nomad-debug-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			src, err := raftboltdb.NewBoltStore(filepath.Join(dir, "src.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+			if err := src.StoreLogs(entries); err != nil {
+				t.Fatal(err)
+			}
+			if err := src.SetUint64([]byte("CurrentTerm"), 2); err != nil {
+				t.Fatal(err)
+			}
+
+			dst, err := raftboltdb.NewBoltStore(filepath.Join(dir, "dst.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+
+			drop := map[uint64]bool{}
+			for _, idx := range c.drop {
+				drop[idx] = true
+			}
+
+			stats, err := rewriteLogs(src, dst, drop, c.truncateAfter, c.dropConfig)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected error containing %q but got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			term, err := dst.GetUint64([]byte("CurrentTerm"))
+			if err != nil || term != 2 {
+				t.Fatalf("expected CurrentTerm 2 but got %d: %v", term, err)
+			}
+
+			first, _ := dst.FirstIndex()
+			last, _ := dst.LastIndex()
+			if first != c.first || last != c.last {
+				t.Fatalf("expected log [%d,%d] but got [%d,%d]", c.first, c.last, first, last)
+			}
+
+			if stats.copied+stats.dropped != int(c.last-c.first+1) || stats.dropped != len(c.dropped) ||
+				stats.truncated != int(20-c.last) {
+				t.Fatalf("unexpected stats %+v", *stats)
+			}
+
+			dropped := map[uint64]bool{}
+			for _, idx := range c.dropped {
+				dropped[idx] = true
+			}
+			for i := first; i <= last; i++ {
+				var got raft.Log
+				if err := dst.GetLog(i, &got); err != nil {
+					t.Fatal(err)
+				}
+				want := entries[i-11]
+				if dropped[i] {
+					if got.Type != raft.LogNoop || got.Term != want.Term || len(got.Data) != 0 {
+						t.Errorf("expected entry %d to be replaced by a no-op, got %+v", i, got)
+					}
+					continue
+				}
+				if got.Type != want.Type || got.Term != want.Term || !bytes.Equal(got.Data, want.Data) {
+					t.Errorf("expected entry %d to be copied as is, got %+v", i, got)
+				}
+			}
+		})
+	}
+}
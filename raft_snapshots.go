@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/raft"
+)
+
+type RaftSnapshotsCommand struct {
+}
+
+func (a *RaftSnapshotsCommand) Help() string {
+	helpText := `
+Usage: nomad-debug raft snapshots <path_to_nomad_dir>
+
+  Emits the list of raft snapshots found in the data dir, newest first, with
+  their index, term, size, raft configuration and CRC check status.
+
+Options:
+
+  --verify=<bool>
+    Check the CRC of every snapshot, which reads snapshots in full.  Defaults
+    to true.
+
+  --format=<format>
+    Output format: json (default), ndjson or csv.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *RaftSnapshotsCommand) Name() string { return "raft snapshots" }
+
+func (c *RaftSnapshotsCommand) Synopsis() string {
+	return "output list of raft snapshots"
+}
+
+func (c *RaftSnapshotsCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *RaftSnapshotsCommand) run(args []string) (int, error) {
+	var fFormat string
+	var fVerify bool
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.StringVar(&fFormat, "format", "json", "")
+	flags.BoolVar(&fVerify, "verify", true, "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) != 1 {
+		return 1, fmt.Errorf("expected one arg but got %d", len(args))
+	}
+
+	dir, err := openDataDir(args[0], serverData)
+	if err != nil {
+		return 1, err
+	}
+	defer dir.Close()
+
+	snaps, err := openSnapshotStore(dir.raftDir)
+	if err != nil {
+		return 1, err
+	}
+
+	snapshots, err := snaps.List()
+	if err != nil {
+		return 1, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	f, err := NewFormatter(fFormat, out, []string{"Snapshot"})
+	if err != nil {
+		return 1, err
+	}
+
+	for _, s := range snapshots {
+		if err := f.Write(newSnapshotInfo(snaps, s, fVerify)); err != nil {
+			return 1, fmt.Errorf("failed to encode output: %v", err)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+
+	return 0, nil
+}
+
+type snapshotInfo struct {
+	ID                 string
+	Index              uint64
+	Term               uint64
+	Size               int64
+	Version            raft.SnapshotVersion
+	ConfigurationIndex uint64
+	Configuration      raft.Configuration
+
+	// CRC is "ok" if the snapshot content matches its checksum, or the
+	// verification error otherwise, or empty if not verified
+	CRC string `json:",omitempty"`
+}
+
+// newSnapshotInfo returns the info of a snapshot.  Verifying the snapshot CRC
+// reads its whole content, so it's only done if verify is set.
+func newSnapshotInfo(snaps *snapshotDir, meta *raft.SnapshotMeta, verify bool) *snapshotInfo {
+	info := &snapshotInfo{
+		ID:                 meta.ID,
+		Index:              meta.Index,
+		Term:               meta.Term,
+		Size:               meta.Size,
+		Version:            meta.Version,
+		ConfigurationIndex: meta.ConfigurationIndex,
+		Configuration:      meta.Configuration,
+	}
+
+	if !verify {
+		return info
+	}
+
+	info.CRC = "ok"
+	if err := snaps.Verify(meta.ID); err != nil {
+		info.CRC = err.Error()
+	}
+
+	return info
+}
+
+type RaftSnapshotDumpCommand struct {
+}
+
+func (a *RaftSnapshotDumpCommand) Help() string {
+	helpText := `
+Usage: nomad-debug raft snapshot dump <snapshot_id> <path_to_nomad_dir>
+       nomad-debug raft snapshot dump <snapshot_archive>
+
+  Emits the nomad server state held by a single raft snapshot, restored into
+  a fresh FSM without applying any raft log entries.
+
+  The snapshot is either found in a data dir by its ID, or is a snapshot
+  archive as produced by 'nomad operator snapshot save', whose checksums are
+  verified.
+
+Options:
+
+  --format=<format>
+    Output format: json (default), ndjson or csv.  csv output requires
+    --output-dir.
+
+  --output-dir=<dir>
+    Write each table to its own file in dir, named after the table, e.g.
+    Allocs.csv, instead of emitting all tables to stdout.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *RaftSnapshotDumpCommand) Name() string { return "raft snapshot dump" }
+
+func (c *RaftSnapshotDumpCommand) Synopsis() string {
+	return "output content of a raft snapshot"
+}
+
+func (c *RaftSnapshotDumpCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *RaftSnapshotDumpCommand) run(args []string) (int, error) {
+	var fFormat, fOutputDir string
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.StringVar(&fFormat, "format", "json", "")
+	flags.StringVar(&fOutputDir, "output-dir", "", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) != 1 && len(args) != 2 {
+		return 1, fmt.Errorf("expected one or two args but got %d", len(args))
+	}
+
+	if fFormat == "csv" && fOutputDir == "" {
+		return 1, fmt.Errorf("csv output requires --output-dir")
+	}
+
+	var st *state.StateStore
+	var err error
+	if len(args) == 1 {
+		st, err = archiveState(args[0])
+	} else {
+		st, err = snapshotState(args[1], args[0])
+	}
+	if err != nil {
+		return 1, err
+	}
+
+	result, err := stateTables(st)
+	if err != nil {
+		return 1, err
+	}
+
+	if fOutputDir != "" {
+		err = writeTableFiles(fFormat, fOutputDir, result, stateTableTypes())
+	} else {
+		err = writeTables(fFormat, os.Stdout, result)
+	}
+	if err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+
+	return 0, nil
+}
+
+// snapshotState returns the server state held by the snapshot with the given
+// ID, found in the data dir, or data dir archive, at p.
+func snapshotState(p, id string) (*state.StateStore, error) {
+	dir, err := openDataDir(p, serverData)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	snaps, err := openSnapshotStore(dir.raftDir)
+	if err != nil {
+		return nil, err
+	}
+
+	_, source, err := snaps.Open(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot %v: %v", id, err)
+	}
+	defer source.Close()
+
+	fsm, err := newFSM()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fsm.Restore(source); err != nil {
+		return nil, fmt.Errorf("failed to restore snapshot %v: %v", id, err)
+	}
+
+	return fsm.State(), nil
+}
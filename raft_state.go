@@ -1,17 +1,19 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-memdb"
-	"github.com/hashicorp/nomad/nomad"
-	"github.com/hashicorp/raft"
+	"github.com/hashicorp/nomad/nomad/state"
 )
 
 type RaftStateCommand struct {
@@ -19,9 +21,13 @@ type RaftStateCommand struct {
 
 func (a *RaftStateCommand) Help() string {
 	helpText := `
-Usage: nomad-debug raft state <path_to_nomad_dir>
+Usage: nomad-debug raft state <path_to_nomad_dir|snapshot_archive>
 
-  Emit the nomad server state obtained by replaying the events of the raft log, in json format.
+  Emit the nomad server state obtained by replaying the events of the raft log,
+  in the output format given by --format.
+
+  If passed a snapshot archive, as produced by 'nomad operator snapshot save',
+  its checksums are verified and the state it holds is emitted.
 
 Options:
 
@@ -29,12 +35,47 @@ Options:
     Set the last log index to be applied, to drop spurious log entries not
     properly commited. If passed last_index is zero or negative, it's perceived
     as an offset from the last index seen in raft.
+
+  --at-index=<index>
+    Emit the state as of the given raft index, restored from the nearest
+    snapshot preceding it.  Fails if the index isn't present in raft, i.e.
+    is past the last log entry or precedes the oldest snapshot followed by
+    the available log entries.
+
+  --at-time=<time>
+    Emit the state as of the given RFC3339 time, i.e. right before the first
+    log entry with a later timestamp.  Entry timestamps are derived from the
+    modify, create and submit times of the objects they hold.
+
+  --tables=<table>[,<table>...]
+    Emit only the given tables, e.g. allocs,evals.
+
+  --namespace=<namespace>
+  --job=<job_id>
+  --node=<node_id>
+  --status=<status>
+    Emit only objects matching the given namespace, job, node or status,
+    looked up through the state store indexes where possible.  Objects
+    lacking the filtered field are omitted.
+
+  --format=<format>
+    Output format: json (default), ndjson or csv.  csv output requires
+    --output-dir.
+
+  --output-dir=<dir>
+    Write each table to its own file in dir, named after the table, e.g.
+    Allocs.csv, instead of emitting all tables to stdout.
+
+  --save-snapshot=<path>
+    Save the replayed state as a new snapshot archive at path, restorable
+    with 'nomad operator snapshot restore', instead of emitting it.  The
+    archive holds the whole state, so table and object filters don't apply.
 `
 
 	return strings.TrimSpace(helpText)
 }
 
-func (c *RaftStateCommand) Name() string { return "raft logs" }
+func (c *RaftStateCommand) Name() string { return "raft state" }
 
 func (c *RaftStateCommand) Synopsis() string {
 	return "output content of raft log"
@@ -50,10 +91,23 @@ func (c *RaftStateCommand) Run(args []string) int {
 
 func (c *RaftStateCommand) run(args []string) (int, error) {
 	var fLastIdx int64
+	var fAtIdx uint64
+	var fFormat, fOutputDir, fAtTime, fTables, fSaveSnapshot string
+	var fNamespace, fJob, fNode, fStatus string
 
 	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
 	flags.Usage = func() { fmt.Println(c.Help()) }
 	flags.Int64Var(&fLastIdx, "last-index", 0, "")
+	flags.Uint64Var(&fAtIdx, "at-index", 0, "")
+	flags.StringVar(&fAtTime, "at-time", "", "")
+	flags.StringVar(&fFormat, "format", "json", "")
+	flags.StringVar(&fOutputDir, "output-dir", "", "")
+	flags.StringVar(&fTables, "tables", "", "")
+	flags.StringVar(&fNamespace, "namespace", "", "")
+	flags.StringVar(&fJob, "job", "", "")
+	flags.StringVar(&fNode, "node", "", "")
+	flags.StringVar(&fStatus, "status", "", "")
+	flags.StringVar(&fSaveSnapshot, "save-snapshot", "", "")
 
 	if err := flags.Parse(args); err != nil {
 		return 1, fmt.Errorf("failed to parse arguments: %v", err)
@@ -64,115 +118,211 @@ func (c *RaftStateCommand) run(args []string) (int, error) {
 		return 1, fmt.Errorf("expected one arg but got %d", len(args))
 	}
 
-	p := filepath.Join(args[0], "server", "raft")
+	if fFormat == "csv" && fOutputDir == "" {
+		return 1, fmt.Errorf("csv output requires --output-dir")
+	}
 
-	store, firstIdx, lastIdx, err := raftState(filepath.Join(p, "raft.db"))
+	q, err := newStateQuery(fTables)
 	if err != nil {
-		return 1, fmt.Errorf("failed to open raft logs: %v", err)
+		return 1, err
 	}
-	defer store.Close()
+	q.Namespace = fNamespace
+	q.Job = fJob
+	q.Node = fNode
+	q.Status = fStatus
 
-	snaps, err := raft.NewFileSnapshotStore(p, 1000, os.Stderr)
-	if err != nil {
-		return 1, fmt.Errorf("failed to open snapshot dir: %v", err)
+	if (fLastIdx != 0 && fAtIdx != 0) || (fLastIdx != 0 && fAtTime != "") || (fAtIdx != 0 && fAtTime != "") {
+		return 1, fmt.Errorf("--last-index, --at-index and --at-time are mutually exclusive")
 	}
 
-	logger := hclog.L()
+	var atTime time.Time
+	if fAtTime != "" {
+		t, err := time.Parse(time.RFC3339, fAtTime)
+		if err != nil {
+			return 1, fmt.Errorf("failed to parse --at-time: %v", err)
+		}
+		atTime = t
+	}
 
-	// use dummy non-enabled FSM depedencies
-	periodicDispatch := nomad.NewPeriodicDispatch(logger, nil)
-	blockedEvals := nomad.NewBlockedEvals(nil, logger)
-	evalBroker, err := nomad.NewEvalBroker(1, 1, 1, 1)
-	if err != nil {
-		return 1, err
+	if fSaveSnapshot != "" && !q.empty() {
+		return 1, fmt.Errorf("--save-snapshot saves the whole state, and can't be used with table or object filters")
 	}
-	fsmConfig := &nomad.FSMConfig{
-		EvalBroker: evalBroker,
-		Periodic:   periodicDispatch,
-		Blocked:    blockedEvals,
-		Logger:     logger,
-		Region:     "default",
+
+	var st *state.StateStore
+	if isSnapshotArchive(args[0]) {
+		if fLastIdx != 0 || fAtIdx != 0 || fAtTime != "" || fSaveSnapshot != "" {
+			return 1, fmt.Errorf("--last-index, --at-index, --at-time and --save-snapshot don't apply to snapshot archives")
+		}
+		st, err = archiveState(args[0])
+		if err != nil {
+			return 1, err
+		}
+	} else {
+		dir, err := openDataDir(args[0], serverData)
+		if err != nil {
+			return 1, err
+		}
+		defer dir.Close()
+
+		r, err := replayAt(dir, fLastIdx, fAtIdx, atTime)
+		if err != nil {
+			return 1, err
+		}
+		defer r.Close()
+
+		if fSaveSnapshot != "" {
+			meta, err := r.saveSnapshot(fSaveSnapshot)
+			if err != nil {
+				return 1, err
+			}
+			fmt.Fprintf(os.Stderr, "saved snapshot %v at index %d to %s\n", meta.ID, meta.Index, fSaveSnapshot)
+			return 0, nil
+		}
+		st = r.state()
 	}
 
-	fsm, err := nomad.NewFSM(fsmConfig)
+	var result map[string][]interface{}
+	if q.empty() {
+		result, err = stateTables(st)
+	} else {
+		result, err = queryTables(st, q)
+	}
 	if err != nil {
 		return 1, err
 	}
 
-	// restore from snapshot first
-	sFirstIdx, err := restoreFromSnapshot(fsm, snaps)
+	if fOutputDir != "" {
+		err = writeTableFiles(fFormat, fOutputDir, result, stateTableTypes())
+	} else {
+		err = writeTables(fFormat, os.Stdout, result)
+	}
 	if err != nil {
-		return 1, err
+		return 1, fmt.Errorf("failed to encode output: %v", err)
 	}
 
-	if sFirstIdx+1 < firstIdx {
-		return 1, fmt.Errorf("missing logs after snapshot [%v,%v]", sFirstIdx+1, firstIdx-1)
-	} else if sFirstIdx > 0 {
-		firstIdx = sFirstIdx + 1
-	}
+	return 0, nil
+}
 
-	lastIdx = lastIndex(lastIdx, fLastIdx)
+// replayAt replays the raft log of the data dir up to the index selected by
+// either cliLastIdx, atIdx or atTime.  The returned replayer must be closed.
+func replayAt(dir *dataDir, cliLastIdx int64, atIdx uint64, atTime time.Time) (*replayer, error) {
+	r, err := newReplayer(dir)
+	if err != nil {
+		return nil, err
+	}
 
-	for i := firstIdx; i <= lastIdx; i++ {
-		var e raft.Log
-		err := store.GetLog(i, &e)
+	idx := lastIndex(r.lastIdx, cliLastIdx)
+	switch {
+	case atIdx != 0:
+		earliest, err := r.earliestIndex()
 		if err != nil {
-			return 1, fmt.Errorf("failed to read log entry at index %d: %v", i, err)
+			r.Close()
+			return nil, err
 		}
-
-		if e.Type == raft.LogCommand {
-			fsm.Apply(&e)
+		if atIdx < earliest || atIdx > r.lastIdx {
+			r.Close()
+			return nil, fmt.Errorf("index %d isn't present in raft, the state can be restored at indexes [%d,%d]", atIdx, earliest, r.lastIdx)
 		}
+		idx = atIdx
+	case !atTime.IsZero():
+		idx, err = r.indexAtTime(atTime)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "emitting state as of index %d\n", idx)
 	}
 
-	state := fsm.State()
-	result := map[string][]interface{}{
-		"ACLPolicies":      toArray(state.ACLPolicies(nil)),
-		"ACLTokens":        toArray(state.ACLTokens(nil)),
-		"Allocs":           toArray(state.Allocs(nil)),
-		"Deployments":      toArray(state.Deployments(nil)),
-		"Evals":            toArray(state.Evals(nil)),
-		"Indexes":          toArray(state.Indexes()),
-		"JobSummaries":     toArray(state.JobSummaries(nil)),
-		"JobVersions":      toArray(state.JobVersions(nil)),
-		"Jobs":             toArray(state.Jobs(nil)),
-		"Nodes":            toArray(state.Nodes(nil)),
-		"PeriodicLaunches": toArray(state.PeriodicLaunches(nil)),
-		"VaultAccessors":   toArray(state.VaultAccessors(nil)),
-	}
-
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(result); err != nil {
-		return 1, fmt.Errorf("failed to encode output: %v", err)
+	if err := r.replayTo(idx, nil); err != nil {
+		r.Close()
+		return nil, err
 	}
 
-	return 0, nil
+	return r, nil
 }
 
-func restoreFromSnapshot(fsm raft.FSM, snaps raft.SnapshotStore) (uint64, error) {
-	snapshots, err := snaps.List()
+// writeTables emits the state store tables, sorted by table name.
+func writeTables(format string, w io.Writer, tables map[string][]interface{}) error {
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	f, err := NewFormatter(format, out, []string{"Table", "Object"})
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	for _, snapshot := range snapshots {
-		_, source, err := snaps.Open(snapshot.ID)
-		if err != nil {
-			continue
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if g, ok := f.(groupWriter); ok {
+			if err := g.WriteGroup(name); err != nil {
+				return err
+			}
 		}
 
-		err = fsm.Restore(source)
-		source.Close()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to restore source %v: %v", snapshot.ID, err)
-			continue
+		for _, o := range tables[name] {
+			if err := f.Write(o, name); err != nil {
+				return err
+			}
 		}
+	}
 
-		return snapshot.Index, nil
+	if err := f.Close(); err != nil {
+		return err
 	}
+	return out.Flush()
+}
 
-	return 0, nil
+// writeTableFiles emits each state store table into its own file in dir.
+// types holds the types of the objects of tables, so that empty tables are
+// laid out too.
+func writeTableFiles(format, dir string, tables map[string][]interface{}, types map[string]reflect.Type) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for name, objs := range tables {
+		if err := writeTableFile(format, filepath.Join(dir, name+"."+format), objs, types[name]); err != nil {
+			return fmt.Errorf("failed to write table %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func writeTableFile(format, p string, objs []interface{}, t reflect.Type) error {
+	file, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	out := bufio.NewWriter(file)
+
+	f, err := NewFormatter(format, out, []string{"Object"})
+	if err != nil {
+		return err
+	}
+	if tw, ok := f.(typedWriter); ok && t != nil {
+		tw.SetValueType(t)
+	}
+	for _, o := range objs {
+		if err := f.Write(o); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
 }
 
 func lastIndex(raftLastIdx uint64, cliLastIdx int64) uint64 {
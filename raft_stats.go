@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashicorp/raft"
+)
+
+// Groups of the size statistics emitted by raft stats
+const (
+	statsTotal       = "Total"
+	statsCommandType = "CommandType"
+	statsJob         = "Job"
+	statsNode        = "Node"
+	statsLargest     = "Largest"
+)
+
+type RaftStatsCommand struct {
+}
+
+func (a *RaftStatsCommand) Help() string {
+	helpText := `
+Usage: nomad-debug raft stats <path_to_nomad_dir>
+
+  Aggregates the count and the encoded size of the raft log entries per
+  command type, per job and per node, and finds the largest entries, e.g. to
+  find the transactions responsible for a growing raft.db.
+
+  Entries referencing multiple jobs or nodes are counted towards each of
+  them.  Jobs are keyed by namespace and ID, e.g. default/example.
+
+Options:
+
+  --from-index=<from_index>
+  --to-index=<to_index>
+  --tail=<n>
+    Aggregate only the given range of entries, as in 'raft logs'.
+
+  --top=<n>
+    Emit only the n jobs and nodes with the largest total size, and the n
+    largest entries.  Defaults to 10; zero emits all jobs, nodes and
+    entries.
+
+  --format=<format>
+    Output format: text (default), json, ndjson or csv.  Largest entries are
+    emitted as stats of a single entry, keyed by command type.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *RaftStatsCommand) Name() string { return "raft stats" }
+
+func (c *RaftStatsCommand) Synopsis() string {
+	return "output size statistics of raft log"
+}
+
+func (c *RaftStatsCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *RaftStatsCommand) run(args []string) (int, error) {
+	var fFromIdx, fToIdx int64
+	var fTail uint64
+	var fTop int
+	var fFormat string
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.Int64Var(&fFromIdx, "from-index", 0, "")
+	flags.Int64Var(&fToIdx, "to-index", 0, "")
+	flags.Uint64Var(&fTail, "tail", 0, "")
+	flags.IntVar(&fTop, "top", 10, "")
+	flags.StringVar(&fFormat, "format", "text", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) != 1 {
+		return 1, fmt.Errorf("expected one arg but got %d", len(args))
+	}
+
+	if fTail != 0 && fFromIdx != 0 {
+		return 1, fmt.Errorf("--tail and --from-index are mutually exclusive")
+	}
+
+	dir, err := openDataDir(args[0], serverData)
+	if err != nil {
+		return 1, err
+	}
+	defer dir.Close()
+
+	p := dir.raftDB
+
+	store, firstIdx, lastIdx, err := raftState(p)
+	if err != nil {
+		return 1, fmt.Errorf("failed to open raft logs: %v", err)
+	}
+	defer store.Close()
+
+	firstIdx, lastIdx = logRange(firstIdx, lastIdx, fFromIdx, fToIdx, fTail)
+
+	agg := newStatsAggregator(fTop)
+	for i := firstIdx; i <= lastIdx && lastIdx != 0; i++ {
+		var e raft.Log
+		if err := store.GetLog(i, &e); err != nil {
+			return 1, fmt.Errorf("failed to read log entry at index %d: %v", i, err)
+		}
+
+		m, err := decode(&e)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to decode log entry at index %d: %v\n", i, err)
+			continue
+		}
+
+		agg.add(&e, m)
+	}
+
+	groups := agg.groups()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	if fFormat == "text" {
+		if err := writeStatsText(out, groups); err != nil {
+			return 1, fmt.Errorf("failed to encode output: %v", err)
+		}
+		return 0, nil
+	}
+
+	f, err := NewFormatter(fFormat, out, []string{"Group", "Stats"})
+	if err != nil {
+		return 1, err
+	}
+	for _, g := range statsGroups {
+		if gw, ok := f.(groupWriter); ok {
+			if err := gw.WriteGroup(g); err != nil {
+				return 1, fmt.Errorf("failed to encode output: %v", err)
+			}
+		}
+		for _, s := range groups[g] {
+			if err := f.Write(s, g); err != nil {
+				return 1, fmt.Errorf("failed to encode output: %v", err)
+			}
+		}
+	}
+	if err := f.Close(); err != nil {
+		return 1, fmt.Errorf("failed to encode output: %v", err)
+	}
+
+	return 0, nil
+}
+
+// statsGroups are the groups of statistics, in output order.
+var statsGroups = []string{statsTotal, statsCommandType, statsJob, statsNode, statsLargest}
+
+// sizeStats aggregates the encoded size of the log entries sharing a key.
+type sizeStats struct {
+	Key        string
+	Count      int
+	TotalBytes int
+	AvgBytes   int
+	MaxBytes   int
+
+	// MaxIndex is the index of the largest entry
+	MaxIndex uint64
+}
+
+func (s *sizeStats) add(e *raft.Log) {
+	size := len(e.Data)
+
+	s.Count++
+	s.TotalBytes += size
+	s.AvgBytes = s.TotalBytes / s.Count
+	if size > s.MaxBytes || s.Count == 1 {
+		s.MaxBytes = size
+		s.MaxIndex = e.Index
+	}
+}
+
+type statsAggregator struct {
+	top int
+
+	total        *sizeStats
+	commandTypes map[string]*sizeStats
+	jobs         map[string]*sizeStats
+	nodes        map[string]*sizeStats
+
+	// largest are the top largest entries, sorted by decreasing size
+	largest []*sizeStats
+}
+
+func newStatsAggregator(top int) *statsAggregator {
+	return &statsAggregator{
+		top:          top,
+		total:        &sizeStats{},
+		commandTypes: map[string]*sizeStats{},
+		jobs:         map[string]*sizeStats{},
+		nodes:        map[string]*sizeStats{},
+	}
+}
+
+func (a *statsAggregator) add(e *raft.Log, m *logMessage) {
+	name := m.CommandType
+	if name == "" {
+		name = m.LogType
+	}
+
+	a.total.add(e)
+	addStats(a.commandTypes, name, e)
+
+	ids := bodyIDs(m.Body)
+	for _, key := range ids.sorted(kindJobKey) {
+		addStats(a.jobs, key, e)
+	}
+	for _, id := range ids.sorted(kindNode) {
+		addStats(a.nodes, id, e)
+	}
+
+	a.addLargest(name, e)
+}
+
+func addStats(stats map[string]*sizeStats, key string, e *raft.Log) {
+	s, ok := stats[key]
+	if !ok {
+		s = &sizeStats{Key: key}
+		stats[key] = s
+	}
+	s.add(e)
+}
+
+func (a *statsAggregator) addLargest(name string, e *raft.Log) {
+	n := len(a.largest)
+	if a.top > 0 && n == a.top && len(e.Data) <= a.largest[n-1].MaxBytes {
+		return
+	}
+
+	s := &sizeStats{Key: name}
+	s.add(e)
+
+	// without a limit, all entries are kept, and sorted once done
+	if a.top <= 0 {
+		a.largest = append(a.largest, s)
+		return
+	}
+
+	i := sort.Search(n, func(i int) bool { return a.largest[i].MaxBytes < s.MaxBytes })
+	a.largest = append(a.largest, nil)
+	copy(a.largest[i+1:], a.largest[i:])
+	a.largest[i] = s
+
+	if len(a.largest) > a.top {
+		a.largest = a.largest[:a.top]
+	}
+}
+
+// groups returns the statistics of each group, sorted by decreasing total
+// size.  Jobs, nodes and largest entries are limited to the top ones.
+func (a *statsAggregator) groups() map[string][]*sizeStats {
+	a.total.Key = "all"
+
+	if a.top <= 0 {
+		sort.SliceStable(a.largest, func(i, j int) bool {
+			return a.largest[i].MaxBytes > a.largest[j].MaxBytes
+		})
+	}
+
+	return map[string][]*sizeStats{
+		statsTotal:       {a.total},
+		statsCommandType: sortedStats(a.commandTypes, 0),
+		statsJob:         sortedStats(a.jobs, a.top),
+		statsNode:        sortedStats(a.nodes, a.top),
+		statsLargest:     append([]*sizeStats{}, a.largest...),
+	}
+}
+
+func sortedStats(stats map[string]*sizeStats, top int) []*sizeStats {
+	r := make([]*sizeStats, 0, len(stats))
+	for _, s := range stats {
+		r = append(r, s)
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].TotalBytes != r[j].TotalBytes {
+			return r[i].TotalBytes > r[j].TotalBytes
+		}
+		return r[i].Key < r[j].Key
+	})
+
+	if top > 0 && len(r) > top {
+		r = r[:top]
+	}
+	return r
+}
+
+func writeStatsText(w *bufio.Writer, groups map[string][]*sizeStats) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	for i, g := range statsGroups {
+		if i != 0 {
+			fmt.Fprintln(tw)
+		}
+
+		if g == statsLargest {
+			fmt.Fprintln(tw, "Largest\tIndex\tBytes")
+			for _, s := range groups[g] {
+				fmt.Fprintf(tw, "%s\t%d\t%d\n", s.Key, s.MaxIndex, s.MaxBytes)
+			}
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\tCount\tTotal Bytes\tAvg Bytes\tMax Bytes\tMax Index\n", g)
+		for _, s := range groups[g] {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", s.Key, s.Count, s.TotalBytes, s.AvgBytes, s.MaxBytes, s.MaxIndex)
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/raft"
+)
+
+func TestStatsAggregator(t *testing.T) {
+	type entry struct {
+		size        int
+		commandType string
+		body        interface{}
+	}
+
+	entries := []entry{
+		{100, "JobRegisterRequestType", &structs.JobRegisterRequest{
+			Job: &structs.Job{ID: "web", Namespace: "default"},
+		}},
+		{50, "JobRegisterRequestType", &structs.JobRegisterRequest{
+			Job:          &structs.Job{ID: "web", Namespace: "prod"},
+			WriteRequest: structs.WriteRequest{Namespace: "prod"},
+		}},
+		{10, "NodeRegisterRequestType", &structs.NodeRegisterRequest{
+			Node: &structs.Node{ID: "node1"},
+		}},
+		{30, "EvalUpdateRequestType", &structs.EvalUpdateRequest{
+			Evals: []*structs.Evaluation{{ID: "eval1", Namespace: "prod", JobID: "web", NodeID: "node1"}},
+		}},
+	}
+
+	cases := []struct {
+		name    string
+		top     int
+		jobs    map[string]int
+		nodes   map[string]int
+		largest []uint64
+	}{
+		{
+			name:    "all",
+			top:     0,
+			jobs:    map[string]int{"default/web": 100, "prod/web": 80},
+			nodes:   map[string]int{"node1": 40},
+			largest: []uint64{1, 2, 4, 3},
+		},
+		{
+			name:    "negative top",
+			top:     -1,
+			jobs:    map[string]int{"default/web": 100, "prod/web": 80},
+			nodes:   map[string]int{"node1": 40},
+			largest: []uint64{1, 2, 4, 3},
+		},
+		{
+			name:    "top 1",
+			top:     1,
+			jobs:    map[string]int{"default/web": 100},
+			nodes:   map[string]int{"node1": 40},
+			largest: []uint64{1},
+		},
+		{
+			name:    "top 3",
+			top:     3,
+			jobs:    map[string]int{"default/web": 100, "prod/web": 80},
+			nodes:   map[string]int{"node1": 40},
+			largest: []uint64{1, 2, 4},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			agg := newStatsAggregator(c.top)
+			for i, e := range entries {
+				l := &raft.Log{Index: uint64(i + 1), Type: raft.LogCommand, Data: make([]byte, e.size)}
+				agg.add(l, &logMessage{LogType: "LogCommand", CommandType: e.commandType, Body: e.body})
+			}
+			groups := agg.groups()
+
+			total := groups[statsTotal][0]
+			if total.Count != 4 || total.TotalBytes != 190 || total.MaxBytes != 100 || total.MaxIndex != 1 {
+				t.Errorf("unexpected total stats %+v", *total)
+			}
+
+			if n := len(groups[statsCommandType]); n != 3 {
+				t.Errorf("expected 3 command types but got %d", n)
+			}
+
+			checkStats := func(group string, expected map[string]int) {
+				got := map[string]int{}
+				for _, s := range groups[group] {
+					got[s.Key] = s.TotalBytes
+				}
+				if len(got) != len(expected) {
+					t.Errorf("expected %s stats %v but got %v", group, expected, got)
+					return
+				}
+				for k, v := range expected {
+					if got[k] != v {
+						t.Errorf("expected %s stats %v but got %v", group, expected, got)
+						return
+					}
+				}
+			}
+			checkStats(statsJob, c.jobs)
+			checkStats(statsNode, c.nodes)
+
+			var largest []uint64
+			for _, s := range groups[statsLargest] {
+				largest = append(largest, s.MaxIndex)
+			}
+			if len(largest) != len(c.largest) {
+				t.Fatalf("expected largest entries %v but got %v", c.largest, largest)
+			}
+			for i := range largest {
+				if largest[i] != c.largest[i] {
+					t.Fatalf("expected largest entries %v but got %v", c.largest, largest)
+				}
+			}
+		})
+	}
+}
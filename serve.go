@@ -0,0 +1,681 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/version"
+)
+
+const (
+	// defaultBlockingWait and maxBlockingWait bound how long blocking
+	// queries are held, as the nomad agent does.
+	defaultBlockingWait = 5 * time.Minute
+	maxBlockingWait     = 10 * time.Minute
+)
+
+type ServeCommand struct {
+}
+
+func (a *ServeCommand) Help() string {
+	helpText := `
+Usage: nomad-debug serve [options] <path_to_nomad_dir|snapshot_archive>
+
+  Replays the raft log into the nomad server state, as 'raft state' does, and
+  serves the read endpoints of the nomad HTTP API from that state, so that
+  the nomad CLI and UI can inspect the state of a dead cluster, e.g.:
+
+    $ NOMAD_ADDR=http://127.0.0.1:4646 nomad job status example
+
+  Served endpoints:
+
+    /v1/jobs
+    /v1/job/<id>[/allocations|/evaluations|/summary|/versions|/deployments|/deployment]
+    /v1/allocations
+    /v1/allocation/<id>
+    /v1/evaluations
+    /v1/evaluation/<id>[/allocations]
+    /v1/nodes
+    /v1/node/<id>[/allocations]
+    /v1/deployments
+    /v1/deployment/<id>
+    /v1/deployment/allocations/<id>
+    /v1/namespaces
+
+  List endpoints honor the prefix and namespace query parameters, including
+  the * namespace wildcard.  The agent, region, leader and ACL token
+  endpoints queried by the UI on startup get static responses of a single
+  server agent with ACLs disabled.  Writes and client endpoints (e.g. logs
+  and stats) aren't served.  As the state never changes, blocking queries are
+  held for their whole wait time.
+
+Options:
+
+  --addr=<address>
+    Address to listen on, 127.0.0.1:4646 by default.
+
+  --last-index=<last_index>
+  --at-index=<index>
+  --at-time=<time>
+    Serve the state as of the given raft index or time, as in 'raft state'.
+`
+
+	return strings.TrimSpace(helpText)
+}
+
+func (c *ServeCommand) Name() string { return "serve" }
+
+func (c *ServeCommand) Synopsis() string {
+	return "serve nomad HTTP API read endpoints from replayed state"
+}
+
+func (c *ServeCommand) Run(args []string) int {
+	r, err := c.run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return r
+}
+
+func (c *ServeCommand) run(args []string) (int, error) {
+	var fLastIdx int64
+	var fAtIdx uint64
+	var fAddr, fAtTime string
+
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(c.Help()) }
+	flags.StringVar(&fAddr, "addr", "127.0.0.1:4646", "")
+	flags.Int64Var(&fLastIdx, "last-index", 0, "")
+	flags.Uint64Var(&fAtIdx, "at-index", 0, "")
+	flags.StringVar(&fAtTime, "at-time", "", "")
+
+	if err := flags.Parse(args); err != nil {
+		return 1, fmt.Errorf("failed to parse arguments: %v", err)
+	}
+	args = flags.Args()
+
+	if len(args) != 1 {
+		return 1, fmt.Errorf("expected one arg but got %d", len(args))
+	}
+
+	if (fLastIdx != 0 && fAtIdx != 0) || (fLastIdx != 0 && fAtTime != "") || (fAtIdx != 0 && fAtTime != "") {
+		return 1, fmt.Errorf("--last-index, --at-index and --at-time are mutually exclusive")
+	}
+
+	var atTime time.Time
+	if fAtTime != "" {
+		t, err := time.Parse(time.RFC3339, fAtTime)
+		if err != nil {
+			return 1, fmt.Errorf("failed to parse --at-time: %v", err)
+		}
+		atTime = t
+	}
+
+	var st *state.StateStore
+	var err error
+	if isSnapshotArchive(args[0]) {
+		if fLastIdx != 0 || fAtIdx != 0 || fAtTime != "" {
+			return 1, fmt.Errorf("--last-index, --at-index and --at-time don't apply to snapshot archives")
+		}
+		st, err = archiveState(args[0])
+		if err != nil {
+			return 1, err
+		}
+	} else {
+		dir, err := openDataDir(args[0], serverData)
+		if err != nil {
+			return 1, err
+		}
+		defer dir.Close()
+
+		r, err := replayAt(dir, fLastIdx, fAtIdx, atTime)
+		if err != nil {
+			return 1, err
+		}
+		defer r.Close()
+		st = r.state()
+	}
+
+	idx, err := st.LatestIndex()
+	if err != nil {
+		return 1, fmt.Errorf("failed to read state index: %v", err)
+	}
+
+	handler, err := newStateAPI(st, fAddr)
+	if err != nil {
+		return 1, err
+	}
+
+	srv := &http.Server{Addr: fAddr, Handler: handler}
+
+	// close the server on interrupt, so that temporary files get removed
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		srv.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "serving state at index %d on http://%s\n", idx, fAddr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return 1, fmt.Errorf("failed to serve: %v", err)
+	}
+
+	return 0, nil
+}
+
+// apiHandler returns the object to be encoded as the response of a request.
+type apiHandler func(req *http.Request) (interface{}, error)
+
+// apiError is an error responded with a given status code.
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func notFound(what string) error {
+	return &apiError{code: http.StatusNotFound, msg: what + " not found"}
+}
+
+// stateAPI serves the read endpoints of the nomad HTTP API from a state
+// store.
+type stateAPI struct {
+	state *state.StateStore
+	mux   *http.ServeMux
+
+	// addr is the address the api is served on, reported as the leader one
+	addr string
+
+	// region is the region of the state jobs, and namespaces the namespaces
+	// of the state objects, both computed once as the state never changes
+	region     string
+	namespaces []string
+}
+
+func newStateAPI(st *state.StateStore, addr string) (*stateAPI, error) {
+	a := &stateAPI{state: st, mux: http.NewServeMux(), addr: addr}
+	if err := a.readClusterInfo(); err != nil {
+		return nil, err
+	}
+
+	routes := []struct {
+		pattern string
+		table   string
+		fn      apiHandler
+	}{
+		{"/v1/jobs", "Jobs", a.jobs},
+		{"/v1/job/", "Jobs", a.job},
+		{"/v1/allocations", "Allocs", a.allocs},
+		{"/v1/allocation/", "Allocs", a.alloc},
+		{"/v1/evaluations", "Evals", a.evals},
+		{"/v1/evaluation/", "Evals", a.eval},
+		{"/v1/nodes", "Nodes", a.nodes},
+		{"/v1/node/", "Nodes", a.node},
+		{"/v1/deployments", "Deployments", a.deployments},
+		{"/v1/deployment/", "Deployments", a.deployment},
+
+		// static endpoints the UI and CLI query on startup
+		{"/v1/agent/self", "", a.agentSelf},
+		{"/v1/regions", "", a.regions},
+		{"/v1/status/leader", "", a.leader},
+		{"/v1/namespaces", "", a.listNamespaces},
+		{"/v1/acl/token/self", "", a.aclTokenSelf},
+	}
+
+	for _, r := range routes {
+		table := ""
+		if r.table != "" {
+			schema, ok := stateSchema[r.table]
+			if !ok {
+				return nil, fmt.Errorf("state table %s not found", r.table)
+			}
+			table = schema.Name
+		}
+		a.handle(r.pattern, table, r.fn)
+	}
+
+	return a, nil
+}
+
+// readClusterInfo collects the region and namespaces of the state objects.
+func (a *stateAPI) readClusterInfo() error {
+	namespaces := map[string]bool{structs.DefaultNamespace: true}
+	for _, table := range []string{"Jobs", "Allocs", "Evals", "Deployments"} {
+		objs, err := readTable(a.state, table)
+		if err != nil {
+			return err
+		}
+
+		for _, o := range objs {
+			switch o := o.(type) {
+			case *structs.Job:
+				namespaces[o.Namespace] = true
+				if a.region == "" {
+					a.region = o.Region
+				}
+			case *structs.Allocation:
+				namespaces[o.Namespace] = true
+			case *structs.Evaluation:
+				namespaces[o.Namespace] = true
+			case *structs.Deployment:
+				namespaces[o.Namespace] = true
+			}
+		}
+	}
+
+	if a.region == "" {
+		a.region = "global"
+	}
+
+	for ns := range namespaces {
+		a.namespaces = append(a.namespaces, ns)
+	}
+	sort.Strings(a.namespaces)
+	return nil
+}
+
+func (a *stateAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.mux.ServeHTTP(w, req)
+}
+
+// handle registers fn for GET requests of pattern, responding with the query
+// meta headers of the given memdb table, or of the whole state if empty.
+func (a *stateAPI) handle(pattern, table string, fn apiHandler) {
+	a.mux.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var index uint64
+		var err error
+		if table != "" {
+			index, err = a.state.Index(table)
+		} else {
+			index, err = a.state.LatestIndex()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		blockQuery(req, index)
+
+		w.Header().Set("X-Nomad-Index", strconv.FormatUint(index, 10))
+		w.Header().Set("X-Nomad-KnownLeader", "true")
+		w.Header().Set("X-Nomad-LastContact", "0")
+
+		obj, err := fn(req)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if e, ok := err.(*apiError); ok {
+				code = e.code
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		if _, ok := req.URL.Query()["pretty"]; ok {
+			enc.SetIndent("", "    ")
+		}
+		if err := enc.Encode(obj); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode response of %s: %v\n", req.URL.Path, err)
+		}
+	})
+}
+
+// blockQuery holds blocking queries waiting for an index past the state one
+// for their wait time, as the served state never changes.
+func blockQuery(req *http.Request, index uint64) {
+	q := req.URL.Query()
+	minIdx, err := strconv.ParseUint(q.Get("index"), 10, 64)
+	if err != nil || index > minIdx {
+		return
+	}
+
+	wait := defaultBlockingWait
+	if d, err := time.ParseDuration(q.Get("wait")); err == nil && d > 0 {
+		wait = d
+	}
+	if wait > maxBlockingWait {
+		wait = maxBlockingWait
+	}
+
+	select {
+	case <-time.After(wait):
+	case <-req.Context().Done():
+	}
+}
+
+func namespace(req *http.Request) string {
+	if ns := req.URL.Query().Get("namespace"); ns != "" {
+		return ns
+	}
+	return structs.DefaultNamespace
+}
+
+// stubFunc converts a state object into the object listed by the api.
+type stubFunc func(raw interface{}) (interface{}, error)
+
+func allocStub(raw interface{}) (interface{}, error) { return raw.(*structs.Allocation).Stub(), nil }
+
+func nodeStub(raw interface{}) (interface{}, error) { return raw.(*structs.Node).Stub(), nil }
+
+// list returns the objects of iter, converted by stub if not nil.
+func list(iter memdb.ResultIterator, err error, stub stubFunc) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	return appendIterator([]interface{}{}, iter, stub)
+}
+
+// listNamespaced returns the objects listed by fn in the namespace of the
+// request, or in all namespaces for the * wildcard, converted by stub if not
+// nil.
+func (a *stateAPI) listNamespaced(req *http.Request, fn func(ns string) (memdb.ResultIterator, error), stub stubFunc) (interface{}, error) {
+	namespaces := []string{namespace(req)}
+	if namespaces[0] == "*" {
+		namespaces = a.namespaces
+	}
+
+	r := []interface{}{}
+	for _, ns := range namespaces {
+		iter, err := fn(ns)
+		if err != nil {
+			return nil, err
+		}
+		if r, err = appendIterator(r, iter, stub); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func appendIterator(r []interface{}, iter memdb.ResultIterator, stub stubFunc) ([]interface{}, error) {
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		if stub != nil {
+			var err error
+			if raw, err = stub(raw); err != nil {
+				return nil, err
+			}
+		}
+		r = append(r, raw)
+	}
+	return r, nil
+}
+
+func allocStubs(allocs []*structs.Allocation, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	r := make([]*structs.AllocListStub, 0, len(allocs))
+	for _, alloc := range allocs {
+		r = append(r, alloc.Stub())
+	}
+	return r, nil
+}
+
+// subPath splits the path following prefix into an object id and one of the
+// given sub-resources.  As ids may hold slashes, e.g. the ids of dispatched
+// jobs, the last path segment is only taken as a sub-resource if the whole
+// path isn't the id of an object, as reported by exists.
+func subPath(req *http.Request, prefix string, exists func(id string) (bool, error), subs ...string) (string, string, error) {
+	rest := strings.TrimPrefix(req.URL.Path, prefix)
+
+	i := strings.LastIndex(rest, "/")
+	if i == -1 {
+		return rest, "", nil
+	}
+
+	sub := rest[i+1:]
+	for _, s := range subs {
+		if s != sub {
+			continue
+		}
+
+		ok, err := exists(rest)
+		if err != nil {
+			return "", "", err
+		}
+		if ok {
+			return rest, "", nil
+		}
+		return rest[:i], sub, nil
+	}
+	return rest, "", nil
+}
+
+func (a *stateAPI) agentSelf(req *http.Request) (interface{}, error) {
+	return map[string]interface{}{
+		"config": map[string]interface{}{
+			"Region":     a.region,
+			"Datacenter": "",
+			"NodeName":   "nomad-debug",
+			"Version": map[string]interface{}{
+				"Version":           version.Version,
+				"VersionPrerelease": version.VersionPrerelease,
+			},
+			"ACL": map[string]interface{}{"Enabled": false},
+		},
+		"member": map[string]interface{}{
+			"Name":   "nomad-debug." + a.region,
+			"Addr":   a.addr,
+			"Status": "alive",
+			"Tags": map[string]string{
+				"region": a.region,
+				"role":   "nomad",
+			},
+		},
+		"stats": map[string]interface{}{},
+	}, nil
+}
+
+func (a *stateAPI) regions(req *http.Request) (interface{}, error) {
+	return []string{a.region}, nil
+}
+
+func (a *stateAPI) leader(req *http.Request) (interface{}, error) {
+	return a.addr, nil
+}
+
+func (a *stateAPI) listNamespaces(req *http.Request) (interface{}, error) {
+	r := make([]*api.Namespace, 0, len(a.namespaces))
+	for _, ns := range a.namespaces {
+		r = append(r, &api.Namespace{Name: ns})
+	}
+	return r, nil
+}
+
+// aclTokenSelf responds as agents with ACLs disabled do.
+func (a *stateAPI) aclTokenSelf(req *http.Request) (interface{}, error) {
+	return nil, &apiError{code: http.StatusBadRequest, msg: "ACL support disabled"}
+}
+
+func (a *stateAPI) jobs(req *http.Request) (interface{}, error) {
+	fn := func(ns string) (memdb.ResultIterator, error) {
+		return a.state.JobsByNamespace(nil, ns)
+	}
+	if prefix := req.URL.Query().Get("prefix"); prefix != "" {
+		fn = func(ns string) (memdb.ResultIterator, error) {
+			return a.state.JobsByIDPrefix(nil, ns, prefix)
+		}
+	}
+
+	return a.listNamespaced(req, fn, func(raw interface{}) (interface{}, error) {
+		job := raw.(*structs.Job)
+		summary, err := a.state.JobSummaryByID(nil, job.Namespace, job.ID)
+		if err != nil {
+			return nil, err
+		}
+		return job.Stub(summary), nil
+	})
+}
+
+func (a *stateAPI) job(req *http.Request) (interface{}, error) {
+	ns := namespace(req)
+	all := req.URL.Query().Get("all") == "true"
+
+	exists := func(id string) (bool, error) {
+		job, err := a.state.JobByID(nil, ns, id)
+		return job != nil, err
+	}
+	id, sub, err := subPath(req, "/v1/job/", exists,
+		"allocations", "evaluations", "summary", "versions", "deployments", "deployment")
+	if err != nil {
+		return nil, err
+	}
+
+	switch sub {
+	case "allocations":
+		return allocStubs(a.state.AllocsByJob(nil, ns, id, all))
+	case "evaluations":
+		return a.state.EvalsByJob(nil, ns, id)
+	case "summary":
+		summary, err := a.state.JobSummaryByID(nil, ns, id)
+		if err == nil && summary == nil {
+			return nil, notFound("job summary")
+		}
+		return summary, err
+	case "versions":
+		jobs, err := a.state.JobVersionsByID(nil, ns, id)
+		if err == nil && len(jobs) == 0 {
+			return nil, notFound("job versions")
+		}
+		return &structs.JobVersionsResponse{Versions: jobs}, err
+	case "deployments":
+		return a.state.DeploymentsByJobID(nil, ns, id, all)
+	case "deployment":
+		return a.state.LatestDeploymentByJobID(nil, ns, id)
+	}
+
+	job, err := a.state.JobByID(nil, ns, id)
+	if err == nil && job == nil {
+		return nil, notFound("job")
+	}
+	return job, err
+}
+
+func (a *stateAPI) allocs(req *http.Request) (interface{}, error) {
+	fn := func(ns string) (memdb.ResultIterator, error) {
+		return a.state.AllocsByNamespace(nil, ns)
+	}
+	if prefix := req.URL.Query().Get("prefix"); prefix != "" {
+		fn = func(ns string) (memdb.ResultIterator, error) {
+			return a.state.AllocsByIDPrefix(nil, ns, prefix)
+		}
+	}
+	return a.listNamespaced(req, fn, allocStub)
+}
+
+func (a *stateAPI) alloc(req *http.Request) (interface{}, error) {
+	id := strings.TrimPrefix(req.URL.Path, "/v1/allocation/")
+
+	alloc, err := a.state.AllocByID(nil, id)
+	if err == nil && alloc == nil {
+		return nil, notFound("alloc")
+	}
+	return alloc, err
+}
+
+func (a *stateAPI) evals(req *http.Request) (interface{}, error) {
+	fn := func(ns string) (memdb.ResultIterator, error) {
+		return a.state.EvalsByNamespace(nil, ns)
+	}
+	if prefix := req.URL.Query().Get("prefix"); prefix != "" {
+		fn = func(ns string) (memdb.ResultIterator, error) {
+			return a.state.EvalsByIDPrefix(nil, ns, prefix)
+		}
+	}
+	return a.listNamespaced(req, fn, nil)
+}
+
+func (a *stateAPI) eval(req *http.Request) (interface{}, error) {
+	exists := func(id string) (bool, error) {
+		eval, err := a.state.EvalByID(nil, id)
+		return eval != nil, err
+	}
+	id, sub, err := subPath(req, "/v1/evaluation/", exists, "allocations")
+	if err != nil {
+		return nil, err
+	}
+	if sub == "allocations" {
+		return allocStubs(a.state.AllocsByEval(nil, id))
+	}
+
+	eval, err := a.state.EvalByID(nil, id)
+	if err == nil && eval == nil {
+		return nil, notFound("eval")
+	}
+	return eval, err
+}
+
+func (a *stateAPI) nodes(req *http.Request) (interface{}, error) {
+	if prefix := req.URL.Query().Get("prefix"); prefix != "" {
+		iter, err := a.state.NodesByIDPrefix(nil, prefix)
+		return list(iter, err, nodeStub)
+	}
+	iter, err := a.state.Nodes(nil)
+	return list(iter, err, nodeStub)
+}
+
+func (a *stateAPI) node(req *http.Request) (interface{}, error) {
+	exists := func(id string) (bool, error) {
+		node, err := a.state.NodeByID(nil, id)
+		return node != nil, err
+	}
+	id, sub, err := subPath(req, "/v1/node/", exists, "allocations")
+	if err != nil {
+		return nil, err
+	}
+	if sub == "allocations" {
+		return a.state.AllocsByNode(nil, id)
+	}
+
+	node, err := a.state.NodeByID(nil, id)
+	if err == nil && node == nil {
+		return nil, notFound("node")
+	}
+	return node, err
+}
+
+func (a *stateAPI) deployments(req *http.Request) (interface{}, error) {
+	fn := func(ns string) (memdb.ResultIterator, error) {
+		return a.state.DeploymentsByNamespace(nil, ns)
+	}
+	if prefix := req.URL.Query().Get("prefix"); prefix != "" {
+		fn = func(ns string) (memdb.ResultIterator, error) {
+			return a.state.DeploymentsByIDPrefix(nil, ns, prefix)
+		}
+	}
+	return a.listNamespaced(req, fn, nil)
+}
+
+func (a *stateAPI) deployment(req *http.Request) (interface{}, error) {
+	rest := strings.TrimPrefix(req.URL.Path, "/v1/deployment/")
+	if strings.HasPrefix(rest, "allocations/") {
+		return allocStubs(a.state.AllocsByDeployment(nil, strings.TrimPrefix(rest, "allocations/")))
+	}
+
+	d, err := a.state.DeploymentByID(nil, rest)
+	if err == nil && d == nil {
+		return nil, notFound("deployment")
+	}
+	return d, err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestStateAPI(t *testing.T) {
+	fsm, err := newFSM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fsm.State()
+
+	job := mock.Job()
+	if err := st.UpsertJob(1000, job); err != nil {
+		t.Fatal(err)
+	}
+
+	// a job whose ID ends like a job sub-resource
+	summaryJob := mock.Job()
+	summaryJob.ID = "web/summary"
+	if err := st.UpsertJob(1001, summaryJob); err != nil {
+		t.Fatal(err)
+	}
+
+	prodJob := mock.Job()
+	prodJob.Namespace = "prod"
+	if err := st.UpsertJob(1002, prodJob); err != nil {
+		t.Fatal(err)
+	}
+
+	alloc := mock.Alloc()
+	alloc.Job = job
+	alloc.JobID = job.ID
+	alloc.Namespace = job.Namespace
+	if err := st.UpsertAllocs(1003, []*structs.Allocation{alloc}); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newStateAPI(st, "127.0.0.1:4646")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+
+		// length is the expected number of listed objects, if not -1
+		length int
+
+		// field and value are a field of the responded object and its
+		// expected value, if field isn't empty
+		field string
+		value string
+	}{
+		{name: "jobs", path: "/v1/jobs", code: 200, length: 2},
+		{name: "jobs of namespace", path: "/v1/jobs?namespace=prod", code: 200, length: 1},
+		{name: "jobs of all namespaces", path: "/v1/jobs?namespace=*", code: 200, length: 3},
+		{name: "jobs by prefix", path: "/v1/jobs?prefix=web", code: 200, length: 1},
+		{name: "job", path: "/v1/job/" + job.ID, code: 200, length: -1, field: "ID", value: job.ID},
+		{name: "job of namespace", path: "/v1/job/" + prodJob.ID + "?namespace=prod", code: 200, length: -1, field: "Namespace", value: "prod"},
+		{name: "job of other namespace", path: "/v1/job/" + prodJob.ID, code: 404, length: -1},
+		{name: "job allocations", path: "/v1/job/" + job.ID + "/allocations", code: 200, length: 1},
+		{name: "job summary", path: "/v1/job/" + job.ID + "/summary", code: 200, length: -1, field: "JobID", value: job.ID},
+		{name: "job with sub-resource id", path: "/v1/job/web/summary", code: 200, length: -1, field: "ID", value: "web/summary"},
+		{name: "summary of job with sub-resource id", path: "/v1/job/web/summary/summary", code: 200, length: -1, field: "JobID", value: "web/summary"},
+		{name: "missing job", path: "/v1/job/missing", code: 404, length: -1},
+		{name: "missing job summary", path: "/v1/job/missing/summary", code: 404, length: -1},
+		{name: "missing job versions", path: "/v1/job/missing/versions", code: 404, length: -1},
+		{name: "allocs", path: "/v1/allocations", code: 200, length: 1},
+		{name: "alloc", path: "/v1/allocation/" + alloc.ID, code: 200, length: -1, field: "ID", value: alloc.ID},
+		{name: "missing alloc", path: "/v1/allocation/missing", code: 404, length: -1},
+		{name: "missing eval", path: "/v1/evaluation/missing", code: 404, length: -1},
+		{name: "missing node", path: "/v1/node/missing", code: 404, length: -1},
+		{name: "missing deployment", path: "/v1/deployment/missing", code: 404, length: -1},
+		{name: "regions", path: "/v1/regions", code: 200, length: 1},
+		{name: "namespaces", path: "/v1/namespaces", code: 200, length: 2},
+		{name: "acl token", path: "/v1/acl/token/self", code: 400, length: -1},
+		{name: "post", method: "POST", path: "/v1/jobs", code: 405, length: -1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			method := c.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			u, err := url.Parse(srv.URL + c.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(method, u.String(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != c.code {
+				t.Fatalf("expected status %d but got %d", c.code, resp.StatusCode)
+			}
+			if c.code != 200 {
+				return
+			}
+			if resp.Header.Get("X-Nomad-Index") == "" {
+				t.Errorf("missing X-Nomad-Index header")
+			}
+
+			var body interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			if c.length != -1 {
+				l, ok := body.([]interface{})
+				if !ok || len(l) != c.length {
+					t.Fatalf("expected a list of %d objects but got %v", c.length, body)
+				}
+			}
+			if c.field != "" {
+				obj, _ := body.(map[string]interface{})
+				if obj[c.field] != c.value {
+					t.Fatalf("expected %s %q but got %v", c.field, c.value, obj[c.field])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/raft"
+)
+
+// Snapshot archives, as produced by `nomad operator snapshot save`, are
+// gzipped tar files holding the raft snapshot metadata, the FSM snapshot and
+// the checksums of both.
+const (
+	archiveMetaFile  = "meta.json"
+	archiveStateFile = "state.bin"
+	archiveSumsFile  = "SHA256SUMS"
+)
+
+// isSnapshotArchive returns whether p is a snapshot archive, rather than a
+// nomad data dir or an archive of one, by looking at its first file.
+func isSnapshotArchive(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return false
+	}
+	defer gz.Close()
+
+	hdr, err := tar.NewReader(gz).Next()
+	if err != nil {
+		return false
+	}
+
+	switch hdr.Name {
+	case archiveMetaFile, archiveStateFile, archiveSumsFile:
+		return true
+	}
+	return false
+}
+
+// archiveState returns the server state held by a snapshot archive.
+func archiveState(p string) (*state.StateStore, error) {
+	fsm, err := newFSM()
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := restoreSnapshotArchive(fsm, p)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(os.Stderr, "restored snapshot archive %v at index %d\n", meta.ID, meta.Index)
+	return fsm.State(), nil
+}
+
+// restoreSnapshotArchive verifies the checksums of a snapshot archive and
+// restores it into the fsm.
+func restoreSnapshotArchive(fsm raft.FSM, p string) (*raft.SnapshotMeta, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tmp, err := ioutil.TempFile("", "nomad-debug-snapshot-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	meta, err := readSnapshotArchive(f, tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot archive %s: %v", p, err)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if err := fsm.Restore(tmp); err != nil {
+		return nil, fmt.Errorf("failed to restore snapshot archive %s: %v", p, err)
+	}
+
+	return meta, nil
+}
+
+// readSnapshotArchive reads a snapshot archive, copying the FSM snapshot
+// into out, and verifying the checksums of its files.
+func readSnapshotArchive(in io.Reader, out io.Writer) (*raft.SnapshotMeta, error) {
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var meta raft.SnapshotMeta
+	var metaHash, stateHash hash.Hash
+	var sums map[string]string
+
+	archive := tar.NewReader(gz)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch hdr.Name {
+		case archiveMetaFile:
+			metaHash = sha256.New()
+			var buf bytes.Buffer
+			if _, err := io.Copy(io.MultiWriter(&buf, metaHash), archive); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", hdr.Name, err)
+			}
+			if err := json.Unmarshal(buf.Bytes(), &meta); err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %v", hdr.Name, err)
+			}
+		case archiveStateFile:
+			stateHash = sha256.New()
+			if _, err := io.Copy(io.MultiWriter(out, stateHash), archive); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", hdr.Name, err)
+			}
+		case archiveSumsFile:
+			sums, err = readSums(archive)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", hdr.Name, err)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected file %q in archive", hdr.Name)
+		}
+	}
+
+	switch {
+	case metaHash == nil:
+		return nil, fmt.Errorf("missing %s", archiveMetaFile)
+	case stateHash == nil:
+		return nil, fmt.Errorf("missing %s", archiveStateFile)
+	case sums == nil:
+		return nil, fmt.Errorf("missing %s", archiveSumsFile)
+	}
+
+	for name, h := range map[string]hash.Hash{archiveMetaFile: metaHash, archiveStateFile: stateHash} {
+		expected, ok := sums[name]
+		if !ok {
+			return nil, fmt.Errorf("missing checksum for %s", name)
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+			return nil, fmt.Errorf("checksum mismatch for %s: expected %s but got %s", name, expected, actual)
+		}
+	}
+
+	return &meta, nil
+}
+
+// readSums parses a SHA256SUMS file, mapping file names to their hex
+// encoded checksums.
+func readSums(r io.Reader) (map[string]string, error) {
+	sums := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid checksum line: %q", line)
+		}
+		sums[fields[1]] = fields[0]
+	}
+
+	return sums, scanner.Err()
+}
+
+// saveSnapshotArchive persists the fsm state into a new snapshot archive at p,
+// restorable with 'nomad operator snapshot restore'.  meta.Size is set to the
+// size of the persisted state.
+func saveSnapshotArchive(fsm raft.FSM, meta *raft.SnapshotMeta, p string) error {
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot state: %v", err)
+	}
+	defer snap.Release()
+
+	tmp, err := ioutil.TempFile("", "nomad-debug-snapshot-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := snap.Persist(&fileSink{File: tmp, id: meta.ID}); err != nil {
+		return fmt.Errorf("failed to persist state: %v", err)
+	}
+
+	meta.Size, err = tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot archive: %v", err)
+	}
+
+	err = writeSnapshotArchive(f, meta, tmp)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(p)
+		return fmt.Errorf("failed to write snapshot archive %s: %v", p, err)
+	}
+
+	return nil
+}
+
+// writeSnapshotArchive writes a snapshot archive holding the metadata and the
+// FSM snapshot read from state, along with their checksums.
+func writeSnapshotArchive(w io.Writer, meta *raft.SnapshotMeta, state io.Reader) error {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	metaHash := sha256.New()
+	if err := writeArchiveFile(archive, archiveMetaFile, int64(len(metaJSON)), io.TeeReader(bytes.NewReader(metaJSON), metaHash)); err != nil {
+		return err
+	}
+
+	stateHash := sha256.New()
+	if err := writeArchiveFile(archive, archiveStateFile, meta.Size, io.TeeReader(state, stateHash)); err != nil {
+		return err
+	}
+
+	sums := fmt.Sprintf("%s  %s\n%s  %s\n",
+		hex.EncodeToString(metaHash.Sum(nil)), archiveMetaFile,
+		hex.EncodeToString(stateHash.Sum(nil)), archiveStateFile)
+	if err := writeArchiveFile(archive, archiveSumsFile, int64(len(sums)), strings.NewReader(sums)); err != nil {
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeArchiveFile(archive *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := archive.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if _, err := io.Copy(archive, r); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// fileSink is a raft snapshot sink persisting into a file, which is left open
+// for the caller to read back.
+type fileSink struct {
+	*os.File
+	id string
+}
+
+func (s *fileSink) ID() string    { return s.id }
+func (s *fileSink) Cancel() error { return nil }
+func (s *fileSink) Close() error  { return nil }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/raft"
+)
+
+func TestSnapshotArchive_RoundTrip(t *testing.T) {
+	fsm, err := newFSM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := fsm.State()
+	if err := st.UpsertNode(1000, mock.Node()); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpsertJob(1001, mock.Job()); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpsertEvals(1002, []*structs.Evaluation{mock.Eval(), mock.Eval()}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "nomad-debug-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "snapshot.snap")
+	meta := &raft.SnapshotMeta{ID: "2-1002-1", Index: 1002, Term: 2, Version: raft.SnapshotVersionMax}
+	if err := saveSnapshotArchive(fsm, meta, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isSnapshotArchive(p) {
+		t.Fatalf("%s isn't detected as a snapshot archive", p)
+	}
+
+	restored, err := newFSM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredMeta, err := restoreSnapshotArchive(restored, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredMeta.ID != meta.ID || restoredMeta.Index != meta.Index || restoredMeta.Term != meta.Term || restoredMeta.Size != meta.Size {
+		t.Fatalf("expected meta %+v but got %+v", meta, restoredMeta)
+	}
+
+	before, err := stateTables(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := stateTables(restored.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Nodes", "Jobs", "Evals"} {
+		if len(after[name]) != len(before[name]) || len(after[name]) == 0 {
+			t.Fatalf("expected %d objects in table %s but got %d", len(before[name]), name, len(after[name]))
+		}
+	}
+
+	diffs, err := diffTables(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, d := range diffs {
+		t.Errorf("table %s differs after restore: %d changed objects", name, len(d))
+	}
+
+	// saving must not overwrite an existing file
+	if err := saveSnapshotArchive(fsm, meta, p); err == nil {
+		t.Fatalf("expected saving over existing %s to fail", p)
+	}
+}
+
+type testArchiveFile struct {
+	name    string
+	content string
+}
+
+func testArchive(t *testing.T, files ...testArchiveFile) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for _, f := range files {
+		if err := writeArchiveFile(archive, f.name, int64(len(f.content)), strings.NewReader(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testSum(name, content string) string {
+	h := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("%s  %s\n", hex.EncodeToString(h[:]), name)
+}
+
+func TestReadSnapshotArchive(t *testing.T) {
+	state := "fsm state"
+	meta := &raft.SnapshotMeta{ID: "2-10-1", Index: 10, Term: 2, Size: int64(len(state))}
+
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaFile := testArchiveFile{archiveMetaFile, string(metaJSON)}
+	stateFile := testArchiveFile{archiveStateFile, state}
+	sums := testSum(archiveMetaFile, string(metaJSON)) + testSum(archiveStateFile, state)
+
+	var written bytes.Buffer
+	if err := writeSnapshotArchive(&written, meta, strings.NewReader(state)); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		archive []byte
+		err     string
+	}{
+		{
+			name:    "written",
+			archive: written.Bytes(),
+		},
+		{
+			name:    "valid",
+			archive: testArchive(t, metaFile, stateFile, testArchiveFile{archiveSumsFile, sums}),
+		},
+		{
+			name:    "sums first",
+			archive: testArchive(t, testArchiveFile{archiveSumsFile, sums}, stateFile, metaFile),
+		},
+		{
+			name: "tampered state",
+			archive: testArchive(t, metaFile, testArchiveFile{archiveStateFile, "other state"},
+				testArchiveFile{archiveSumsFile, sums}),
+			err: "checksum mismatch for state.bin",
+		},
+		{
+			name: "tampered meta",
+			archive: testArchive(t, testArchiveFile{archiveMetaFile, `{"ID":"other"}`}, stateFile,
+				testArchiveFile{archiveSumsFile, sums}),
+			err: "checksum mismatch for meta.json",
+		},
+		{
+			name:    "missing state checksum",
+			archive: testArchive(t, metaFile, stateFile, testArchiveFile{archiveSumsFile, testSum(archiveMetaFile, string(metaJSON))}),
+			err:     "missing checksum for state.bin",
+		},
+		{
+			name:    "missing sums",
+			archive: testArchive(t, metaFile, stateFile),
+			err:     "missing SHA256SUMS",
+		},
+		{
+			name:    "missing state",
+			archive: testArchive(t, metaFile, testArchiveFile{archiveSumsFile, sums}),
+			err:     "missing state.bin",
+		},
+		{
+			name:    "invalid sums",
+			archive: testArchive(t, metaFile, stateFile, testArchiveFile{archiveSumsFile, "garbage\n"}),
+			err:     "invalid checksum line",
+		},
+		{
+			name:    "unexpected file",
+			archive: testArchive(t, metaFile, stateFile, testArchiveFile{"../etc/passwd", ""}, testArchiveFile{archiveSumsFile, sums}),
+			err:     `unexpected file "../etc/passwd"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			got, err := readSnapshotArchive(bytes.NewReader(c.archive), &out)
+
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected error containing %q but got %v", c.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != meta.ID || got.Index != meta.Index || got.Term != meta.Term {
+				t.Fatalf("expected meta %+v but got %+v", meta, got)
+			}
+			if out.String() != state {
+				t.Fatalf("expected state %q but got %q", state, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+// snapshotDir reads the snapshots of a raft dir, laid out as by
+// raft.FileSnapshotStore.  Unlike the latter, it never writes to the dir,
+// which may be read-only or belong to a running agent.
+type snapshotDir struct {
+	path string
+}
+
+// snapshotDirMeta is the content of the meta.json file of a snapshot.
+type snapshotDirMeta struct {
+	raft.SnapshotMeta
+	CRC []byte
+}
+
+// openSnapshotStore opens the snapshots found in the raft dir.  If the raft
+// dir has no snapshots dir, e.g. when passed a lone raft.db file, the store
+// holds no snapshots.
+func openSnapshotStore(raftDir string) (*snapshotDir, error) {
+	p := filepath.Join(raftDir, "snapshots")
+	if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+		return nil, fmt.Errorf("failed to open snapshot dir: %s isn't a dir", p)
+	}
+	return &snapshotDir{path: p}, nil
+}
+
+func (d *snapshotDir) Create(version raft.SnapshotVersion, index, term uint64,
+	configuration raft.Configuration, configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+	return nil, fmt.Errorf("snapshot dir %s is read-only", d.path)
+}
+
+// List returns the metadata of the snapshots, newest first, skipping
+// snapshots being written and snapshots whose metadata can't be read.
+func (d *snapshotDir) List() ([]*raft.SnapshotMeta, error) {
+	entries, err := ioutil.ReadDir(d.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*raft.SnapshotMeta
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+
+		meta, err := d.readMeta(e.Name())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read snapshot %v, skipping it: %v\n", e.Name(), err)
+			continue
+		}
+		if meta.Version < raft.SnapshotVersionMin || meta.Version > raft.SnapshotVersionMax {
+			fmt.Fprintf(os.Stderr, "snapshot %v has unsupported version %d, skipping it\n", e.Name(), meta.Version)
+			continue
+		}
+
+		snapshots = append(snapshots, &meta.SnapshotMeta)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		return a.ID > b.ID
+	})
+	return snapshots, nil
+}
+
+// Open returns the metadata and content of a snapshot.  The content is
+// checked against the snapshot CRC as it's read: reading it to the end fails
+// on mismatch.
+func (d *snapshotDir) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, err := d.readMeta(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(filepath.Join(d.path, id, "state.bin"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := &crcReader{
+		r:    bufio.NewReader(f),
+		f:    f,
+		hash: crc64.New(crc64.MakeTable(crc64.ECMA)),
+		want: meta.CRC,
+	}
+	return &meta.SnapshotMeta, r, nil
+}
+
+// Verify reads the whole content of a snapshot, and checks it against the
+// snapshot CRC.
+func (d *snapshotDir) Verify(id string) error {
+	_, source, err := d.Open(id)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = io.Copy(ioutil.Discard, source)
+	return err
+}
+
+func (d *snapshotDir) readMeta(id string) (*snapshotDirMeta, error) {
+	if id == "" || id != filepath.Base(id) || id == ".." {
+		return nil, fmt.Errorf("invalid snapshot id %q", id)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(d.path, id, "meta.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &snapshotDirMeta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, fmt.Errorf("failed to decode meta.json: %v", err)
+	}
+	return meta, nil
+}
+
+// crcReader hashes the content read through it, and fails at the end of the
+// content if the hash doesn't match the expected CRC.
+type crcReader struct {
+	r    io.Reader
+	f    *os.File
+	hash hash.Hash64
+	want []byte
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(c.hash.Sum(nil), c.want) {
+		return n, fmt.Errorf("CRC mismatch")
+	}
+	return n, err
+}
+
+func (c *crcReader) Close() error {
+	return c.f.Close()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+)
+
+// objectDiff describes the change of a state store object.
+type objectDiff struct {
+	Key    string
+	Change string
+
+	// Object is the created or deleted object
+	Object interface{} `json:",omitempty"`
+
+	// Fields are the changed fields of an updated object
+	Fields []fieldDiff `json:",omitempty"`
+}
+
+type fieldDiff struct {
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+// tableKeyFields lists readable fields identifying objects of state tables,
+// for tables whose id index doesn't render well.
+var tableKeyFields = map[string][]string{
+	"JobVersions": {"Namespace", "ID", "Version"},
+}
+
+// objectKey returns the key identifying an object within its table.  Keys
+// are built from the id index of the table when it renders readable keys,
+// and from the Namespace and ID fields otherwise, e.g. for UUID indexes.
+func objectKey(table string, obj interface{}) string {
+	fields, ok := tableKeyFields[table]
+	if ok {
+		return fieldsKey(obj, fields)
+	}
+
+	key, readable, found := schemaObjectKey(table, obj)
+	if found && readable {
+		return key
+	}
+
+	if fk := fieldsKey(obj, []string{"Namespace", "ID"}); fk != "" || !found {
+		return fk
+	}
+	return key
+}
+
+// fieldsKey joins the values of the named fields of obj, skipping missing
+// fields.
+func fieldsKey(obj interface{}, fields []string) string {
+	v := indirect(reflect.ValueOf(obj))
+	if v.Kind() != reflect.Struct {
+		return fmt.Sprint(obj)
+	}
+
+	parts := make([]string, 0, len(fields))
+	for _, name := range fields {
+		f := v.FieldByName(name)
+		if !f.IsValid() {
+			continue
+		}
+		parts = append(parts, fmt.Sprint(f.Interface()))
+	}
+	return strings.Join(parts, "/")
+}
+
+// diffTables compares two versions of the state store tables, and returns
+// the changed objects of each table, sorted by key.
+func diffTables(before, after map[string][]interface{}) (map[string][]*objectDiff, error) {
+	result := map[string][]*objectDiff{}
+
+	names := map[string]bool{}
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+
+	for name := range names {
+		diffs, err := diffTable(name, before[name], after[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff table %s: %v", name, err)
+		}
+		if len(diffs) != 0 {
+			result[name] = diffs
+		}
+	}
+
+	return result, nil
+}
+
+func diffTable(table string, before, after []interface{}) ([]*objectDiff, error) {
+	old := make(map[string]interface{}, len(before))
+	for _, o := range before {
+		old[objectKey(table, o)] = o
+	}
+
+	var diffs []*objectDiff
+	seen := make(map[string]bool, len(after))
+	for _, o := range after {
+		key := objectKey(table, o)
+		seen[key] = true
+
+		d, err := diffObject(key, old[key], o)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			diffs = append(diffs, d)
+		}
+	}
+
+	for key, o := range old {
+		if !seen[key] {
+			diffs = append(diffs, &objectDiff{Key: key, Change: changeDeleted, Object: o})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs, nil
+}
+
+// diffObject returns the change between two versions of an object, where a
+// nil version indicates its absence, or nil if the object didn't change.
+func diffObject(key string, before, after interface{}) (*objectDiff, error) {
+	bNil, aNil := isNil(before), isNil(after)
+	switch {
+	case bNil && aNil:
+		return nil, nil
+	case bNil:
+		return &objectDiff{Key: key, Change: changeCreated, Object: after}, nil
+	case aNil:
+		return &objectDiff{Key: key, Change: changeDeleted, Object: before}, nil
+	}
+
+	// state store objects are immutable, so the same pointer means no change
+	bv, av := reflect.ValueOf(before), reflect.ValueOf(after)
+	if bv.Kind() == reflect.Ptr && av.Kind() == reflect.Ptr && bv.Pointer() == av.Pointer() {
+		return nil, nil
+	}
+
+	b, err := toGeneric(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := toGeneric(after)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []fieldDiff
+	diffValues("", b, a, &fields)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	return &objectDiff{Key: key, Change: changeUpdated, Fields: fields}, nil
+}
+
+func isNil(v interface{}) bool {
+	return !indirect(reflect.ValueOf(v)).IsValid()
+}
+
+// toGeneric converts v into its json representation as maps and slices,
+// preserving numbers as is.
+func toGeneric(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var r interface{}
+	if err := dec.Decode(&r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func diffValues(path string, before, after interface{}, out *[]fieldDiff) {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		a, ok := after.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(b)+len(a))
+		for k := range b {
+			keys = append(keys, k)
+		}
+		for k := range a {
+			if _, ok := b[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			diffValues(p, b[k], a[k], out)
+		}
+		return
+
+	case []interface{}:
+		a, ok := after.([]interface{})
+		if !ok || len(a) != len(b) {
+			break
+		}
+
+		for i := range b {
+			diffValues(fmt.Sprintf("%s[%d]", path, i), b[i], a[i], out)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(before, after) {
+		*out = append(*out, fieldDiff{Path: path, Old: before, New: after})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestObjectKey(t *testing.T) {
+	cases := []struct {
+		name  string
+		table string
+		obj   interface{}
+		key   string
+	}{
+		{"readable id index", "Jobs", &structs.Job{Namespace: "default", ID: "web"}, "default/web"},
+		{"key fields", "JobVersions", &structs.Job{Namespace: "default", ID: "web", Version: 2}, "default/web/2"},
+		{"uuid index", "Nodes", &structs.Node{ID: "5e1a0c2d-6f1b-4f0a-9b7e-0c8d2d3f4a5b"}, "5e1a0c2d-6f1b-4f0a-9b7e-0c8d2d3f4a5b"},
+		{"namespaced uuid index", "Evals", &structs.Evaluation{Namespace: "prod", ID: "5e1a0c2d-6f1b-4f0a-9b7e-0c8d2d3f4a5b"}, "prod/5e1a0c2d-6f1b-4f0a-9b7e-0c8d2d3f4a5b"},
+		{"unknown table", "Other", &structs.Job{Namespace: "default", ID: "web"}, "default/web"},
+		{"non-struct", "Other", "value", "value"},
+	}
+
+	for _, c := range cases {
+		if key := objectKey(c.table, c.obj); key != c.key {
+			t.Errorf("%s: expected key %q but got %q", c.name, c.key, key)
+		}
+	}
+}
+
+func TestDiffTables(t *testing.T) {
+	const evalID = "5e1a0c2d-6f1b-4f0a-9b7e-0c8d2d3f4a5b"
+
+	updated := &structs.Job{
+		Namespace:   "default",
+		ID:          "a",
+		Priority:    50,
+		Datacenters: []string{"dc1"},
+		Meta:        map[string]string{"k": "v", "same": "x"},
+	}
+	deleted := &structs.Job{Namespace: "default", ID: "b"}
+	created := &structs.Job{Namespace: "default", ID: "c"}
+	samePointer := &structs.Job{Namespace: "default", ID: "d"}
+	sameContent := &structs.Job{Namespace: "default", ID: "e", Priority: 50}
+	node := &structs.Node{ID: "5e1a0c2d-6f1b-4f0a-9b7e-0c8d2d3f4a5c"}
+
+	updated2 := *updated
+	updated2.Priority = 70
+	updated2.Datacenters = []string{"dc1", "dc2"}
+	updated2.Meta = map[string]string{"k": "w", "same": "x"}
+	sameContent2 := *sameContent
+
+	before := map[string][]interface{}{
+		"Jobs":  {updated, deleted, samePointer, sameContent},
+		"Nodes": {node},
+	}
+	after := map[string][]interface{}{
+		"Jobs":  {samePointer, created, &updated2, &sameContent2},
+		"Nodes": {node},
+		"Evals": {&structs.Evaluation{Namespace: "default", ID: evalID}},
+	}
+
+	type change struct {
+		key    string
+		change string
+		fields []string
+	}
+	expected := map[string][]change{
+		"Jobs": {
+			{"default/a", changeUpdated, []string{
+				"Datacenters: [dc1] -> [dc1 dc2]",
+				"Meta.k: v -> w",
+				"Priority: 50 -> 70",
+			}},
+			{"default/b", changeDeleted, nil},
+			{"default/c", changeCreated, nil},
+		},
+		"Evals": {
+			{"default/" + evalID, changeCreated, nil},
+		},
+	}
+
+	result, err := diffTables(before, after)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for table := range result {
+		if _, ok := expected[table]; !ok {
+			t.Errorf("unexpected changes in table %s", table)
+		}
+	}
+	for table, changes := range expected {
+		diffs := result[table]
+		if len(diffs) != len(changes) {
+			t.Errorf("%s: expected %d changes but got %d", table, len(changes), len(diffs))
+			continue
+		}
+
+		for i, c := range changes {
+			d := diffs[i]
+			if d.Key != c.key || d.Change != c.change {
+				t.Errorf("%s: change %d: expected %s %s but got %s %s", table, i, c.key, c.change, d.Key, d.Change)
+				continue
+			}
+
+			if c.change != changeUpdated {
+				if d.Object == nil || d.Fields != nil {
+					t.Errorf("%s: %s: expected the %s object but got fields %v", table, c.key, c.change, d.Fields)
+				}
+				continue
+			}
+
+			var fields []string
+			for _, f := range d.Fields {
+				fields = append(fields, fmt.Sprintf("%s: %v -> %v", f.Path, f.Old, f.New))
+			}
+			if fmt.Sprint(fields) != fmt.Sprint(c.fields) {
+				t.Errorf("%s: %s: expected fields %q but got %q", table, c.key, c.fields, fields)
+			}
+		}
+	}
+}
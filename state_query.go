@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/go-memdb"
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// stateQuery selects the state store tables and objects to be emitted.
+type stateQuery struct {
+	// tables are the selected output table names, or all tables if empty
+	tables map[string]bool
+
+	Namespace string
+	Job       string
+	Node      string
+	Status    string
+}
+
+// newStateQuery returns a query for the comma separated list of tables,
+// matched case insensitively against output or memdb table names.
+func newStateQuery(tables string) (*stateQuery, error) {
+	q := &stateQuery{}
+	if tables == "" {
+		return q, nil
+	}
+
+	names := map[string]string{}
+	for name, schema := range stateSchema {
+		names[strings.ToLower(name)] = name
+		names[schema.Name] = name
+	}
+
+	q.tables = map[string]bool{}
+	for _, t := range strings.Split(tables, ",") {
+		t = strings.TrimSpace(t)
+		name, ok := names[strings.ToLower(t)]
+		if !ok {
+			return nil, fmt.Errorf("unknown table: %q", t)
+		}
+		q.tables[name] = true
+	}
+
+	return q, nil
+}
+
+func (q *stateQuery) empty() bool {
+	return len(q.tables) == 0 && q.Namespace == "" && q.Job == "" && q.Node == "" && q.Status == ""
+}
+
+// jobNamespace returns the namespace of the queried job.
+func (q *stateQuery) jobNamespace() string {
+	if q.Namespace == "" {
+		return structs.DefaultNamespace
+	}
+	return q.Namespace
+}
+
+// match returns whether the object of the given table satisfies the query
+// predicates.  Objects lacking the filtered field don't match.
+func (q *stateQuery) match(table string, obj interface{}) bool {
+	v := indirect(reflect.ValueOf(obj))
+	if v.Kind() != reflect.Struct {
+		return q.Namespace == "" && q.Job == "" && q.Node == "" && q.Status == ""
+	}
+
+	jobField, nodeField := "JobID", "NodeID"
+	switch table {
+	case "Jobs", "JobVersions", "PeriodicLaunches":
+		jobField = "ID"
+	case "Nodes":
+		nodeField = "ID"
+	}
+
+	return matchField(v, q.Namespace, "Namespace") &&
+		matchField(v, q.Job, jobField) &&
+		matchField(v, q.Node, nodeField) &&
+		matchField(v, q.Status, "Status", "ClientStatus")
+}
+
+// matchField returns whether any of the named string fields of v equals
+// want, or true if want is empty.
+func matchField(v reflect.Value, want string, names ...string) bool {
+	if want == "" {
+		return true
+	}
+
+	for _, name := range names {
+		f := v.FieldByName(name)
+		if f.IsValid() && f.Kind() == reflect.String && f.String() == want {
+			return true
+		}
+	}
+	return false
+}
+
+// indexedLookups look up the objects of a table through the state store
+// indexes matching the query.  They return false if no index applies, and
+// the whole table must be scanned.
+var indexedLookups = map[string]func(s *state.StateStore, q *stateQuery) ([]interface{}, bool, error){
+	"Jobs": func(s *state.StateStore, q *stateQuery) ([]interface{}, bool, error) {
+		switch {
+		case q.Job != "":
+			j, err := s.JobByID(nil, q.jobNamespace(), q.Job)
+			return fromSlice([]*structs.Job{j}), true, err
+		case q.Namespace != "":
+			return fromIterator(s.JobsByNamespace(nil, q.Namespace))
+		}
+		return nil, false, nil
+	},
+	"JobVersions": func(s *state.StateStore, q *stateQuery) ([]interface{}, bool, error) {
+		if q.Job == "" {
+			return nil, false, nil
+		}
+		jobs, err := s.JobVersionsByID(nil, q.jobNamespace(), q.Job)
+		return fromSlice(jobs), true, err
+	},
+	"JobSummaries": func(s *state.StateStore, q *stateQuery) ([]interface{}, bool, error) {
+		if q.Job == "" {
+			return nil, false, nil
+		}
+		summary, err := s.JobSummaryByID(nil, q.jobNamespace(), q.Job)
+		return fromSlice([]*structs.JobSummary{summary}), true, err
+	},
+	"PeriodicLaunches": func(s *state.StateStore, q *stateQuery) ([]interface{}, bool, error) {
+		if q.Job == "" {
+			return nil, false, nil
+		}
+		launch, err := s.PeriodicLaunchByID(nil, q.jobNamespace(), q.Job)
+		return fromSlice([]*structs.PeriodicLaunch{launch}), true, err
+	},
+	"Allocs": func(s *state.StateStore, q *stateQuery) ([]interface{}, bool, error) {
+		switch {
+		case q.Job != "":
+			allocs, err := s.AllocsByJob(nil, q.jobNamespace(), q.Job, true)
+			return fromSlice(allocs), true, err
+		case q.Node != "":
+			allocs, err := s.AllocsByNode(nil, q.Node)
+			return fromSlice(allocs), true, err
+		case q.Namespace != "":
+			return fromIterator(s.AllocsByNamespace(nil, q.Namespace))
+		}
+		return nil, false, nil
+	},
+	"Evals": func(s *state.StateStore, q *stateQuery) ([]interface{}, bool, error) {
+		switch {
+		case q.Job != "":
+			evals, err := s.EvalsByJob(nil, q.jobNamespace(), q.Job)
+			return fromSlice(evals), true, err
+		case q.Namespace != "":
+			return fromIterator(s.EvalsByNamespace(nil, q.Namespace))
+		}
+		return nil, false, nil
+	},
+	"Deployments": func(s *state.StateStore, q *stateQuery) ([]interface{}, bool, error) {
+		switch {
+		case q.Job != "":
+			deployments, err := s.DeploymentsByJobID(nil, q.jobNamespace(), q.Job, true)
+			return fromSlice(deployments), true, err
+		case q.Namespace != "":
+			return fromIterator(s.DeploymentsByNamespace(nil, q.Namespace))
+		}
+		return nil, false, nil
+	},
+	"Nodes": func(s *state.StateStore, q *stateQuery) ([]interface{}, bool, error) {
+		if q.Node == "" {
+			return nil, false, nil
+		}
+		node, err := s.NodeByID(nil, q.Node)
+		return fromSlice([]*structs.Node{node}), true, err
+	},
+}
+
+// queryTables returns the content of the state store tables selected by the
+// query, keyed by table name.
+func queryTables(s *state.StateStore, q *stateQuery) (map[string][]interface{}, error) {
+	result := map[string][]interface{}{}
+	for name := range stateSchema {
+		if len(q.tables) != 0 && !q.tables[name] {
+			continue
+		}
+
+		var objs []interface{}
+		var err error
+		found := false
+		if lookup, ok := indexedLookups[name]; ok {
+			objs, found, err = lookup(s, q)
+			if err != nil {
+				return nil, fmt.Errorf("failed to query table %s: %v", name, err)
+			}
+		}
+		if !found {
+			objs, err = readTable(s, name)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		matched := []interface{}{}
+		for _, o := range objs {
+			if q.match(name, o) {
+				matched = append(matched, o)
+			}
+		}
+		result[name] = matched
+	}
+
+	return result, nil
+}
+
+// fromSlice converts a slice of objects into a slice of interfaces, dropping
+// nil objects.
+func fromSlice(slice interface{}) []interface{} {
+	v := reflect.ValueOf(slice)
+
+	r := make([]interface{}, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		if e := v.Index(i); !e.IsNil() {
+			r = append(r, e.Interface())
+		}
+	}
+	return r
+}
+
+func fromIterator(iter memdb.ResultIterator, err error) ([]interface{}, bool, error) {
+	if err != nil {
+		return nil, true, err
+	}
+	return toArray(iter, nil), true, nil
+}
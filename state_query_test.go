@@ -0,0 +1,204 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestNewStateQuery(t *testing.T) {
+	cases := []struct {
+		name   string
+		tables string
+		want   []string
+		err    string
+	}{
+		{"all tables", "", nil, ""},
+		{"output names", "jobs, Allocs", []string{"Allocs", "Jobs"}, ""},
+		{"memdb names", "job_version,csi_volumes", []string{"CSIVolumes", "JobVersions"}, ""},
+		{"unknown table", "Jobs,bogus", nil, `unknown table: "bogus"`},
+	}
+
+	for _, c := range cases {
+		q, err := newStateQuery(c.tables)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error %q but got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+
+		var tables []string
+		for name := range q.tables {
+			tables = append(tables, name)
+		}
+		sort.Strings(tables)
+		if !reflect.DeepEqual(tables, c.want) {
+			t.Errorf("%s: expected tables %v but got %v", c.name, c.want, tables)
+		}
+	}
+}
+
+func TestQueryTables(t *testing.T) {
+	fsm, err := newFSM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fsm.State()
+
+	node1, node2 := mock.Node(), mock.Node()
+	if err := st.UpsertNode(1000, node1); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpsertNode(1001, node2); err != nil {
+		t.Fatal(err)
+	}
+
+	job := mock.Job()
+	prodJob := mock.Job()
+	prodJob.Namespace = "prod"
+	if err := st.UpsertJob(1002, job); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpsertJob(1003, prodJob); err != nil {
+		t.Fatal(err)
+	}
+
+	eval1, eval2 := mock.Eval(), mock.Eval()
+	eval1.JobID = job.ID
+	eval2.JobID, eval2.Namespace = prodJob.ID, prodJob.Namespace
+	if err := st.UpsertEvals(1004, []*structs.Evaluation{eval1, eval2}); err != nil {
+		t.Fatal(err)
+	}
+
+	alloc1, alloc2 := mock.Alloc(), mock.Alloc()
+	alloc1.Job, alloc1.JobID, alloc1.Namespace = job, job.ID, job.Namespace
+	alloc1.NodeID, alloc1.ClientStatus = node1.ID, structs.AllocClientStatusRunning
+	alloc2.Job, alloc2.JobID, alloc2.Namespace = prodJob, prodJob.ID, prodJob.Namespace
+	alloc2.NodeID, alloc2.ClientStatus = node2.ID, structs.AllocClientStatusFailed
+	if err := st.UpsertAllocs(1005, []*structs.Allocation{alloc1, alloc2}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		tables string
+		query  stateQuery
+
+		// ids are the IDs of the expected objects, by table
+		ids map[string][]string
+	}{
+		{
+			"tables",
+			"Jobs,Nodes",
+			stateQuery{},
+			map[string][]string{
+				"Jobs":  {job.ID, prodJob.ID},
+				"Nodes": {node1.ID, node2.ID},
+			},
+		},
+		{
+			"namespace",
+			"Jobs,Allocs,Evals",
+			stateQuery{Namespace: "prod"},
+			map[string][]string{
+				"Jobs":   {prodJob.ID},
+				"Allocs": {alloc2.ID},
+				"Evals":  {eval2.ID},
+			},
+		},
+		{
+			"job",
+			"Jobs,Allocs,Evals",
+			stateQuery{Job: job.ID},
+			map[string][]string{
+				"Jobs":   {job.ID},
+				"Allocs": {alloc1.ID},
+				"Evals":  {eval1.ID},
+			},
+		},
+		{
+			"job of namespace",
+			"Jobs,Allocs",
+			stateQuery{Namespace: "prod", Job: prodJob.ID},
+			map[string][]string{
+				"Jobs":   {prodJob.ID},
+				"Allocs": {alloc2.ID},
+			},
+		},
+		{
+			"job of other namespace",
+			"Jobs,Allocs",
+			stateQuery{Job: prodJob.ID},
+			map[string][]string{
+				"Jobs":   {},
+				"Allocs": {},
+			},
+		},
+		{
+			"node",
+			"Nodes,Allocs",
+			stateQuery{Node: node1.ID},
+			map[string][]string{
+				"Nodes":  {node1.ID},
+				"Allocs": {alloc1.ID},
+			},
+		},
+		{
+			"status",
+			"Nodes,Allocs,Evals",
+			stateQuery{Status: structs.AllocClientStatusFailed},
+			map[string][]string{
+				"Nodes":  {},
+				"Allocs": {alloc2.ID},
+				"Evals":  {},
+			},
+		},
+		{
+			"table lacking the filtered field",
+			"Jobs",
+			stateQuery{Node: node1.ID},
+			map[string][]string{
+				"Jobs": {},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		q, err := newStateQuery(c.tables)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		q.Namespace, q.Job, q.Node, q.Status = c.query.Namespace, c.query.Job, c.query.Node, c.query.Status
+
+		result, err := queryTables(st, q)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+
+		if len(result) != len(c.ids) {
+			t.Errorf("%s: expected %d tables but got %d", c.name, len(c.ids), len(result))
+		}
+		for table, want := range c.ids {
+			got := []string{}
+			for _, o := range result[table] {
+				got = append(got, fieldsKey(o, []string{"ID"}))
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s: expected %v but got %v", c.name, table, want, got)
+			}
+		}
+	}
+}
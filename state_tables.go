@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hashicorp/go-memdb"
+	"github.com/hashicorp/nomad/nomad/state"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// legacyTableNames maps memdb table names to the names used in the output
+// before tables were discovered from the schema.
+var legacyTableNames = map[string]string{
+	"acl_policy":      "ACLPolicies",
+	"acl_token":       "ACLTokens",
+	"allocs":          "Allocs",
+	"deployment":      "Deployments",
+	"evals":           "Evals",
+	"index":           "Indexes",
+	"job_summary":     "JobSummaries",
+	"job_version":     "JobVersions",
+	"jobs":            "Jobs",
+	"nodes":           "Nodes",
+	"periodic_launch": "PeriodicLaunches",
+	"vault_accessors": "VaultAccessors",
+}
+
+// tableNameInitialisms are the words of memdb table names to be upper cased
+// in output table names.
+var tableNameInitialisms = map[string]bool{
+	"acl": true,
+	"csi": true,
+	"id":  true,
+	"si":  true,
+}
+
+// stateSchema maps output table names to the schema of the memdb tables
+// registered by the state package.  Tables are read through tableReaders, so
+// that reading a table added to nomad fails until a reader is added for it.
+var stateSchema = func() map[string]*memdb.TableSchema {
+	r := map[string]*memdb.TableSchema{}
+	for _, factory := range state.GetFactories() {
+		schema := factory()
+		r[tableName(schema.Name)] = schema
+	}
+	return r
+}()
+
+// tableName returns the output name of a memdb table, e.g. CSIVolumes for
+// csi_volumes.
+func tableName(memdbName string) string {
+	if n, ok := legacyTableNames[memdbName]; ok {
+		return n
+	}
+
+	words := strings.FieldsFunc(memdbName, func(r rune) bool {
+		return r == '_' || r == '-'
+	})
+	for i, w := range words {
+		if tableNameInitialisms[w] {
+			words[i] = strings.ToUpper(w)
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(w)
+		words[i] = string(unicode.ToUpper(r)) + w[size:]
+	}
+	return strings.Join(words, "")
+}
+
+// stateTableReader reads the content of a state table through the read
+// methods of the state store.
+type stateTableReader struct {
+	// obj is a nil pointer of the type of the objects of the table
+	obj  interface{}
+	read func(s *state.StateStore) ([]interface{}, error)
+}
+
+// iteratorTable returns the reader of a table listed by a state store method
+// taking a watch set, e.g. (*state.StateStore).Nodes.
+func iteratorTable(obj interface{}, list func(*state.StateStore, memdb.WatchSet) (memdb.ResultIterator, error)) stateTableReader {
+	return stateTableReader{obj, func(s *state.StateStore) ([]interface{}, error) {
+		return readIterator(list(s, nil))
+	}}
+}
+
+// tableReaders are the readers of state tables, keyed by memdb table name.
+var tableReaders = map[string]stateTableReader{
+	"index": {(*state.IndexEntry)(nil), func(s *state.StateStore) ([]interface{}, error) {
+		return readIterator(s.Indexes())
+	}},
+	"nodes":              iteratorTable((*structs.Node)(nil), (*state.StateStore).Nodes),
+	"jobs":               iteratorTable((*structs.Job)(nil), (*state.StateStore).Jobs),
+	"job_summary":        iteratorTable((*structs.JobSummary)(nil), (*state.StateStore).JobSummaries),
+	"job_version":        iteratorTable((*structs.Job)(nil), (*state.StateStore).JobVersions),
+	"deployment":         iteratorTable((*structs.Deployment)(nil), (*state.StateStore).Deployments),
+	"periodic_launch":    iteratorTable((*structs.PeriodicLaunch)(nil), (*state.StateStore).PeriodicLaunches),
+	"evals":              iteratorTable((*structs.Evaluation)(nil), (*state.StateStore).Evals),
+	"allocs":             iteratorTable((*structs.Allocation)(nil), (*state.StateStore).Allocs),
+	"vault_accessors":    iteratorTable((*structs.VaultAccessor)(nil), (*state.StateStore).VaultAccessors),
+	"si_token_accessors": iteratorTable((*structs.SITokenAccessor)(nil), (*state.StateStore).SITokenAccessors),
+	"acl_policy":         iteratorTable((*structs.ACLPolicy)(nil), (*state.StateStore).ACLPolicies),
+	"acl_token":          iteratorTable((*structs.ACLToken)(nil), (*state.StateStore).ACLTokens),
+	"csi_volumes":        iteratorTable((*structs.CSIVolume)(nil), (*state.StateStore).CSIVolumes),
+	"csi_plugins":        iteratorTable((*structs.CSIPlugin)(nil), (*state.StateStore).CSIPlugins),
+	"scaling_policy":     iteratorTable((*structs.ScalingPolicy)(nil), (*state.StateStore).ScalingPolicies),
+	"scaling_event":      iteratorTable((*structs.JobScalingEvents)(nil), (*state.StateStore).ScalingEvents),
+	"autopilot-config": {(*structs.AutopilotConfig)(nil), func(s *state.StateStore) ([]interface{}, error) {
+		_, config, err := s.AutopilotConfig()
+		return fromSlice([]*structs.AutopilotConfig{config}), err
+	}},
+	"scheduler_config": {(*structs.SchedulerConfiguration)(nil), func(s *state.StateStore) ([]interface{}, error) {
+		_, config, err := s.SchedulerConfig()
+		return fromSlice([]*structs.SchedulerConfiguration{config}), err
+	}},
+	"cluster_meta": {(*structs.ClusterMetadata)(nil), func(s *state.StateStore) ([]interface{}, error) {
+		meta, err := s.ClusterMetadata()
+		return fromSlice([]*structs.ClusterMetadata{meta}), err
+	}},
+}
+
+// stateTableTypes returns the types of the objects of state tables, keyed by
+// table name.
+func stateTableTypes() map[string]reflect.Type {
+	r := make(map[string]reflect.Type, len(stateSchema))
+	for name, schema := range stateSchema {
+		if t, ok := tableReaders[schema.Name]; ok {
+			r[name] = reflect.TypeOf(t.obj)
+		}
+	}
+	return r
+}
+
+// readTable returns the content of a state table.  It fails for tables
+// lacking a reader, e.g. tables added to nomad since tableReaders was last
+// updated, rather than silently omitting them.
+func readTable(s *state.StateStore, name string) ([]interface{}, error) {
+	schema, ok := stateSchema[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown state table %s", name)
+	}
+	reader, ok := tableReaders[schema.Name]
+	if !ok {
+		return nil, fmt.Errorf("no reader for state table %s (memdb table %q), nomad-debug needs to be updated for this nomad version", name, schema.Name)
+	}
+
+	objs, err := reader.read(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table %s: %v", name, err)
+	}
+	return objs, nil
+}
+
+func readIterator(iter memdb.ResultIterator, err error) ([]interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	return toArray(iter, nil), nil
+}
+
+// stateTables returns the content of all state store tables, keyed by table
+// name.
+func stateTables(s *state.StateStore) (map[string][]interface{}, error) {
+	result := make(map[string][]interface{}, len(stateSchema))
+	for name := range stateSchema {
+		objs, err := readTable(s, name)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = objs
+	}
+
+	return result, nil
+}
+
+// schemaObjectKey returns the key of an object as computed by the id index
+// of its table, rendering each component of compound keys as a string, or
+// in hex if not printable.  readable is false if any component is rendered
+// in hex, or the index is a UUID index, whose keys are raw bytes.
+func schemaObjectKey(table string, obj interface{}) (key string, readable bool, found bool) {
+	schema, ok := stateSchema[table]
+	if !ok {
+		return "", false, false
+	}
+
+	idx, ok := schema.Indexes["id"]
+	if !ok {
+		return "", false, false
+	}
+
+	indexer, ok := idx.Indexer.(memdb.SingleIndexer)
+	if !ok {
+		return "", false, false
+	}
+
+	found, b, err := indexer.FromObject(obj)
+	if err != nil || !found {
+		return "", false, false
+	}
+
+	_, isUUID := indexer.(*memdb.UUIDFieldIndex)
+	readable = !isUUID
+
+	parts := strings.Split(strings.TrimSuffix(string(b), "\x00"), "\x00")
+	for i, p := range parts {
+		if isUUID || !printable(p) {
+			parts[i] = "0x" + hex.EncodeToString([]byte(p))
+			readable = false
+		}
+	}
+	return strings.Join(parts, "/"), readable, true
+}
+
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
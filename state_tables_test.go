@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestTableReaders_CoverSchema(t *testing.T) {
+	for name, schema := range stateSchema {
+		if _, ok := tableReaders[schema.Name]; !ok {
+			t.Errorf("state table %s (memdb table %q) has no reader", name, schema.Name)
+		}
+	}
+}
+
+func TestStateTables(t *testing.T) {
+	fsm, err := newFSM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := fsm.State()
+	if err := st.UpsertNode(1000, mock.Node()); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpsertJob(1001, mock.Job()); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpsertEvals(1002, []*structs.Evaluation{mock.Eval()}); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := stateTables(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := stateTableTypes()
+	for name := range stateSchema {
+		objs, ok := tables[name]
+		if !ok {
+			t.Errorf("table %s is missing", name)
+			continue
+		}
+		for _, o := range objs {
+			if o != nil && reflect.TypeOf(o) != types[name] {
+				t.Errorf("table %s holds a %T, expected %v", name, o, types[name])
+			}
+		}
+	}
+
+	for _, name := range []string{"Nodes", "Jobs", "JobSummaries", "JobVersions", "Evals"} {
+		if len(tables[name]) != 1 {
+			t.Errorf("expected 1 object in table %s but got %d", name, len(tables[name]))
+		}
+	}
+
+	if _, err := readTable(st, "NoSuchTable"); err == nil {
+		t.Errorf("expected reading an unknown table to fail")
+	}
+}